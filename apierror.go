@@ -0,0 +1,96 @@
+package nrql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is an error reported by New Relic's query API: either a non-200
+// response, or a 200 response whose body is an error rather than a payload.
+// Use `errors.As()` to get at it.
+type APIError struct {
+	// The HTTP status (which may be 200)
+	StatusCode int
+
+	// New Relic's explanation (e.g., "NRQL Syntax Error: ..."), from the
+	// body's "error" field; empty if the body doesn't have one
+	Message string
+
+	// The response body, verbatim
+	Body []byte
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf(
+			"New Relic API error (HTTP %d): %s",
+			e.StatusCode,
+			e.Message,
+		)
+	}
+	return fmt.Sprintf("Wanted HTTP 200; got %d: %s", e.StatusCode, e.Body)
+}
+
+// What New Relic says (in lower case) when a query exceeds its execution
+// budget
+var tooExpensiveMarkers = []string{
+	"took too long",
+	"query timed out",
+	"execution budget",
+}
+
+// `tooExpensive()` returns true if New Relic gave up on the query for taking
+// too long, rather than being briefly unavailable.
+func (e *APIError) tooExpensive() bool {
+	if e.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	message := e.Message
+	if message == "" {
+		message = string(e.Body)
+	}
+	message = strings.ToLower(message)
+	for _, marker := range tooExpensiveMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// `errorMessage()` returns the message of an API error body, or "" if `data`
+// isn't one.
+func errorMessage(data []byte) string {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return ""
+	}
+	return errorFieldMessage(body.Error)
+}
+
+// `errorFieldMessage()` returns the message of an error body's "error" field,
+// which is either a string or an object with a "message" (or "title").
+func errorFieldMessage(field json.RawMessage) string {
+	if isNull(field) {
+		return ""
+	}
+	var message string
+	if json.Unmarshal(field, &message) == nil {
+		return message
+	}
+	var structured struct {
+		Message string `json:"message"`
+		Title   string `json:"title"`
+	}
+	if json.Unmarshal(field, &structured) == nil {
+		if structured.Message != "" {
+			return structured.Message
+		}
+		return structured.Title
+	}
+	return ""
+}
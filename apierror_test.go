@@ -0,0 +1,84 @@
+package nrql
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// `fixtureServer()` serves the fixture `name` with `status` to every request,
+// and counts the requests in `*requests`.
+func fixtureServer(
+	t *testing.T,
+	status int,
+	name string,
+	requests *int,
+) *httptest.Server {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(data)
+		},
+	))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestAPIError(t *testing.T) {
+	const message = "NRQL Syntax Error: Error at line 1 position 17, " +
+		"unexpected 'FORM'"
+	for _, c := range []struct {
+		status  int
+		fixture string
+	}{
+		{http.StatusOK, "error_ok.json"},
+		{http.StatusBadRequest, "error_bad_request.json"},
+	} {
+		var requests int
+		s := fixtureServer(t, c.status, c.fixture, &requests)
+		client := Client{
+			AccountID: "1",
+			QueryKey:  "key",
+			BaseURL:   s.URL,
+			Cache:     NewCache(time.Hour),
+		}
+
+		// Errors aren't cached, so each attempt reaches New Relic
+		for attempt := 1; attempt <= 2; attempt++ {
+			_, err := client.ExecRaw("SELECT * FORM Transaction")
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("%s: wanted an *APIError; got %v", c.fixture, err)
+			}
+			if apiErr.StatusCode != c.status || apiErr.Message != message {
+				t.Errorf(
+					"%s: wanted HTTP %d and %q; got HTTP %d and %q",
+					c.fixture,
+					c.status,
+					message,
+					apiErr.StatusCode,
+					apiErr.Message,
+				)
+			}
+			if requests != attempt {
+				t.Errorf(
+					"%s: wanted %d requests; got %d",
+					c.fixture,
+					attempt,
+					requests,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package nrql
+
+import (
+	"sync"
+	"time"
+)
+
+// A Cache holds successful query responses in memory for `TTL`, so that
+// repeatedly running the same NRQL (e.g., from a dashboard which refreshes
+// every few seconds) doesn't hit the API each time. Responses are cached as
+// raw bytes and decoded afresh on each hit, so callers never share a
+// `Payload`. A Cache is safe for concurrent use, including by copies of the
+// same `Client`.
+type Cache struct {
+	TTL time.Duration
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// `NewCache()` returns an empty cache whose entries live for `ttl`.
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{TTL: ttl}
+}
+
+// `Clear()` drops every entry from the cache.
+func (c *Cache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// A nil cache never hits
+func (c *Cache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// A nil cache discards everything
+func (c *Cache) put(key string, data []byte) {
+	if c == nil || c.TTL <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Expired entries are otherwise only evicted when they're looked up, so
+	// sweep them here to keep queries which are never repeated from
+	// accumulating.
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if c.entries == nil {
+		c.entries = map[string]cacheEntry{}
+	}
+	c.entries[key] = cacheEntry{data: data, expires: now.Add(c.TTL)}
+}
@@ -0,0 +1,47 @@
+package nrql
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyedByEndpoint(t *testing.T) {
+	var requests int
+	s := fixtureServer(t, http.StatusOK, "aggregation.json", &requests)
+	cache := NewCache(time.Hour)
+	base := Client{
+		AccountID: "1",
+		QueryKey:  "key",
+		BaseURL:   s.URL,
+		Cache:     cache,
+	}
+	proxied := base
+	proxied.PathTemplate = "/proxy/v1/accounts/{account_id}/query"
+	other := base
+	other.AccountID = "2"
+
+	for _, c := range []struct {
+		name     string
+		client   Client
+		requests int
+	}{
+		{"first", base, 1},
+		{"repeat", base, 1},
+		{"other path", proxied, 2},
+		{"repeat of other path", proxied, 2},
+		{"other account", other, 3},
+	} {
+		if _, err := c.client.ExecRaw("SELECT count(*) FROM T"); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if requests != c.requests {
+			t.Errorf(
+				"%s: wanted %d requests; got %d",
+				c.name,
+				c.requests,
+				requests,
+			)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package nrql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// The default `InOptions.ChunkSize`
+const DefaultInChunkSize = 500
+
+// InOptions controls `ExecIn()`. The zero value uses chunks of
+// `DefaultInChunkSize` values and drops duplicate rows.
+type InOptions struct {
+	// The most values in each query's IN list; `DefaultInChunkSize` if zero
+	ChunkSize int
+
+	// Whether to keep rows which are identical to an earlier row (e.g., an
+	// event which matched more than one chunk, via a list-valued attribute)
+	KeepDuplicates bool
+}
+
+// `ExecIn()` runs `q` restricted to events whose `attr` is one of `values`
+// (i.e., `WHERE attr IN (...)`, ANDed with `q`'s own conditions), and returns
+// their events as a single payload. A list of thousands of values is too long
+// for a URL (and for NRQL), so it's split into chunks of `opts.ChunkSize`,
+// each queried in turn. Duplicate values are dropped before chunking. Only
+// queries which return events (rather than aggregations) can be chunked,
+// since their results can't otherwise be combined. An empty list of values
+// matches nothing, so nothing is queried; the payload has neither rows nor
+// columns.
+func (c Client) ExecIn(
+	q Query,
+	attr string,
+	values []interface{},
+	opts InOptions,
+) (Payload, error) {
+	return c.ExecInContext(context.Background(), q, attr, values, opts)
+}
+
+// `ExecInContext()` is like `ExecIn()`, but the requests are aborted when
+// `ctx` is done.
+func (c Client) ExecInContext(
+	ctx context.Context,
+	q Query,
+	attr string,
+	values []interface{},
+	opts InOptions,
+) (Payload, error) {
+	if len(values) == 0 {
+		return &PayloadBasic{}, nil
+	}
+	c.LazyEvents = false // the chunks are combined
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultInChunkSize
+	}
+
+	// Values are compared by their NRQL literals, so 1 and 1.0 are the same
+	unique := make([]interface{}, 0, len(values))
+	seenValues := map[string]bool{}
+	for _, value := range values {
+		if literal := quoteValue(value); !seenValues[literal] {
+			seenValues[literal] = true
+			unique = append(unique, value)
+		}
+	}
+
+	where := q.WhereClause
+	seenRows := map[string]bool{}
+	var all *PayloadBasic
+	for start := 0; start < len(unique); start += chunkSize {
+		end := start + chunkSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		q.WhereClause = And(where, In(attr, unique[start:end]...))
+
+		p, err := c.ExecContext(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		basic, ok := p.(*PayloadBasic)
+		if !ok {
+			return nil, fmt.Errorf(
+				"'%s' is a %s payload; only events can be chunked",
+				q,
+				p.Kind(),
+			)
+		}
+
+		events := basic.Results[0].Events[:0]
+		for _, event := range basic.Results[0].Events {
+			if !opts.KeepDuplicates {
+				// Map keys are marshaled in order, so equal events have
+				// equal keys
+				key, err := json.Marshal(event)
+				if err != nil {
+					return nil, err
+				}
+				if seenRows[string(key)] {
+					continue
+				}
+				seenRows[string(key)] = true
+			}
+			events = append(events, event)
+		}
+
+		if all == nil {
+			all = basic
+			all.Results[0].Events = events
+		} else {
+			all.Results[0].Events = append(all.Results[0].Events, events...)
+		}
+	}
+	return all, nil
+}
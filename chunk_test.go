@@ -0,0 +1,50 @@
+package nrql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecIn(t *testing.T) {
+	s := newEventServer(t, 3)
+	p, err := s.client().ExecIn(
+		Query{Columns: []string{"i"}, Table: "T", Limit: -1},
+		"id",
+		[]interface{}{1, 2, 1.0, "3"},
+		InOptions{ChunkSize: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"SELECT i FROM T WHERE id IN (1, 2)",
+		"SELECT i FROM T WHERE id IN ('3')",
+	}
+	if got := s.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted queries %q; got %q", want, got)
+	}
+	// The server ignores the WHERE clause, so the second chunk's events
+	// duplicate the first's
+	rows, err := p.Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, rows, 3)
+}
+
+func TestExecInEmpty(t *testing.T) {
+	s := newEventServer(t, 3)
+	p, err := s.client().ExecIn(
+		Query{Columns: []string{"i"}, Table: "T", Limit: -1},
+		"id",
+		nil,
+		InOptions{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.sent(); len(got) != 0 {
+		t.Errorf("wanted no queries; got %q", got)
+	}
+	checkPayload(t, p, PayloadKindBasic, nil, nil)
+}
@@ -1,65 +1,501 @@
 package nrql
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
+// The version of this package, reported in the default User-Agent
+const Version = "0.1.0"
+
+// The User-Agent sent with requests unless the client overrides it
+const DefaultUserAgent = "nrql2csv/" + Version
+
+// The path of the Insights query API endpoint, unless the client overrides it
+const DefaultPathTemplate = "/v1/accounts/{account_id}/query"
+
 type Client struct {
 	AccountID string
 	QueryKey  string
+
+	// The New Relic region hosting the account: "US" (the default, if empty)
+	// or "EU"
+	Region string
+
+	// The scheme and host (and any path prefix) to send the requests to
+	// instead of the region's API host, e.g. an internal proxy or an
+	// `httptest.Server`'s URL
+	BaseURL string
+
+	// The path of the query endpoint (after `BaseURL`), in which
+	// "{account_id}" stands for `AccountID`; `DefaultPathTemplate` if empty
+	PathTemplate string
+
+	// Sent as the User-Agent header; `DefaultUserAgent` if empty
+	UserAgent string
+
+	// Sends the requests to New Relic; `http.DefaultClient` if nil
+	HTTPClient *http.Client
+
+	// How requests which fail transiently are retried; the zero value
+	// doesn't retry
+	Retry RetryPolicy
+
+	// If positive, a response body larger than this many bytes is abandoned
+	// with `ErrResponseTooLarge` rather than read into memory in full, e.g.
+	// so that a `SELECT *` with a huge LIMIT can't exhaust a server's memory
+	MaxResponseSize int64
+
+	// If set, responses are cached here; see `Uncached()` to bypass it
+	Cache *Cache
+
+	// If set, each request to New Relic waits on this first (cache hits
+	// don't), e.g. to stay under the account's query quota
+	Limiter RateLimiter
+
+	// Optional instrumentation hooks, called before and after each request
+	// to New Relic (but not for cache hits). `OnResponse` is called even if
+	// the request fails, in which case `status` is zero if no response was
+	// received. For example, to log every query:
+	//
+	//	c.OnResponse = func(nrql string, status int, d time.Duration, n int) {
+	//		log.Printf("%s: HTTP %d, %d bytes in %v", nrql, status, n, d)
+	//	}
+	OnRequest  func(nrql string)
+	OnResponse func(nrql string, status int, duration time.Duration, bytes int)
+
+	// If set, a summary of each request to New Relic (NRQL, status, size and
+	// timing, but never credentials) is logged here
+	Logger Logger
+
+	// An optional progress hook for `ExecAll()`, called after each page with
+	// the (1-based) page number and the number of rows fetched so far
+	OnPage func(page, rows int)
+
+	// Whether to return basic payloads (of events) as `*LazyPayloadBasic`s,
+	// which decode their events as their rows are iterated, e.g. so that a
+	// server formatting large extracts doesn't hold every decoded row.
+	// `ExecAll()`, `ExecIn()`, `ExecWindowed()` and `Stream()` combine
+	// payloads of events, so they still decode them in full.
+	LazyEvents bool
 }
 
-func execRaw(accountID, queryKey, nrql string) (Payload, error) {
-	// Build a new request
-	req, err := http.NewRequest(
-		"GET",
-		fmt.Sprintf(
-			"https://insights-api.newrelic.com/v1/accounts/%s/query?%s",
-			accountID,
-			url.Values{"nrql": []string{nrql}}.Encode(),
-		),
-		nil,
-	)
+// Querier executes NRQL queries. `Client` is the real thing; code which
+// depends on a Querier instead can be tested against a fake (see the
+// `nrqltest` package).
+type Querier interface {
+	Exec(q Query) (Payload, error)
+	ExecRaw(nrql string) (Payload, error)
+	ExecContext(ctx context.Context, q Query) (Payload, error)
+	ExecRawContext(ctx context.Context, nrql string) (Payload, error)
+}
+
+// The errors `NewClient()` returns for missing credentials
+var (
+	ErrMissingAccountID = errors.New("Missing New Relic account ID")
+	ErrMissingQueryKey  = errors.New("Missing New Relic query key")
+)
+
+// The error (wrapped, for `errors.Is()`) for a response over
+// `Client.MaxResponseSize`
+var ErrResponseTooLarge = errors.New("Response too large")
+
+// The error (wrapped, for `errors.Is()`, along with the `APIError`) for a
+// query which New Relic gave up on for exceeding its execution budget. It
+// isn't retried, since the same query would only fail again.
+var ErrQueryTooExpensive = errors.New("Query too expensive")
+
+// `NewClient()` returns a client for the given account, configured by `opts`.
+// The account ID and query key are trimmed of surrounding whitespace (e.g., the
+// trailing newline of a secrets file); if either is then empty, the error is
+// `ErrMissingAccountID` or `ErrMissingQueryKey` respectively, rather than a
+// confusing HTTP 403 from the first query.
+func NewClient(accountID, queryKey string, opts ...Option) (*Client, error) {
+	c := &Client{
+		AccountID: strings.TrimSpace(accountID),
+		QueryKey:  strings.TrimSpace(queryKey),
+	}
+	if c.AccountID == "" {
+		return nil, ErrMissingAccountID
+	}
+	if c.QueryKey == "" {
+		return nil, ErrMissingQueryKey
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// `Uncached()` returns a copy of the client which neither reads from nor
+// writes to the cache.
+func (c Client) Uncached() Client {
+	c.Cache = nil
+	return c
+}
+
+// The Insights API hosts, keyed by region
+var regionHosts = map[string]string{
+	"US": "insights-api.newrelic.com",
+	"EU": "insights-api.eu.newrelic.com",
+}
+
+func userAgentOr(userAgent string) string {
+	if userAgent == "" {
+		return DefaultUserAgent
+	}
+	return userAgent
+}
+
+func (c Client) host() (string, error) {
+	if c.Region == "" {
+		return regionHosts["US"], nil
+	}
+	if host, ok := regionHosts[strings.ToUpper(c.Region)]; ok {
+		return host, nil
+	}
+	return "", fmt.Errorf("Unknown New Relic region: %s", c.Region)
+}
+
+func (c Client) execRaw(ctx context.Context, nrql string) (Payload, error) {
+	data, _, err := c.fetch(ctx, nrql)
 	if err != nil {
 		return nil, err
 	}
+	return c.decode(data)
+}
+
+// `decode()` decodes a response body, lazily if `c.LazyEvents` is set.
+func (c Client) decode(data []byte) (Payload, error) {
+	return guessPayload(data, c.LazyEvents)
+}
+
+// `fetch()` returns the response body for `nrql`, consulting the cache first.
+func (c Client) fetch(
+	ctx context.Context,
+	nrql string,
+) ([]byte, Response, error) {
+	// The same NRQL means different things on different accounts (and
+	// endpoints), so the key is the whole URL, which names all of them. If
+	// there's no URL, there's nothing to cache; the attempt reports why.
+	key, err := c.requestURL(nrql)
+	if err != nil {
+		return c.fetchUncached(ctx, nrql)
+	}
+	if data, ok := c.Cache.get(key); ok {
+		return data, Response{Cached: true}, nil
+	}
+
+	data, rsp, err := c.fetchUncached(ctx, nrql)
+	if err != nil {
+		return nil, rsp, err
+	}
+	c.Cache.put(key, data)
+	return data, rsp, nil
+}
+
+// `fetchUncached()` requests `nrql` from New Relic, retrying according to
+// `c.Retry`.
+func (c Client) fetchUncached(
+	ctx context.Context,
+	nrql string,
+) ([]byte, Response, error) {
+	for attempt := 1; ; attempt++ {
+		data, rsp, err := c.attempt(ctx, nrql)
+		if err == nil {
+			return data, rsp, nil
+		}
+		if attempt >= c.Retry.MaxAttempts ||
+			!c.Retry.retryable(ctx, rsp.StatusCode, err) {
+			return nil, rsp, err
+		}
+
+		delay := c.Retry.delay(attempt)
+		loggerOr(c.Logger).Printf(
+			"nrql: retrying in %v (attempt %d of %d failed): %v",
+			delay,
+			attempt,
+			c.Retry.MaxAttempts,
+			err,
+		)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, rsp, err
+		}
+	}
+}
+
+// `attempt()` makes a single request for `nrql`, with the instrumentation
+// hooks; every attempt counts against `c.Limiter`.
+func (c Client) attempt(
+	ctx context.Context,
+	nrql string,
+) ([]byte, Response, error) {
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, Response{}, err
+		}
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(nrql)
+	}
+	start := time.Now()
+	data, rsp, err := c.do(ctx, nrql)
+	duration := time.Since(start)
+	if c.OnResponse != nil {
+		c.OnResponse(nrql, rsp.StatusCode, duration, len(data))
+	}
+	loggerOr(c.Logger).Printf(
+		"nrql: HTTP %d, %d bytes in %v: %s",
+		rsp.StatusCode,
+		len(data),
+		duration,
+		nrql,
+	)
+	return data, rsp, err
+}
+
+// `requestURL()` returns the URL to request `nrql` from: the endpoint, with
+// the query in its `nrql` parameter (alongside any others the endpoint
+// already has).
+func (c Client) requestURL(nrql string) (string, error) {
+	base := strings.TrimSuffix(c.BaseURL, "/")
+	if base == "" {
+		host, err := c.host()
+		if err != nil {
+			return "", err
+		}
+		base = "https://" + host
+	}
+	path := c.PathTemplate
+	if path == "" {
+		path = DefaultPathTemplate
+	}
+	endpoint := base + strings.Replace(path, "{account_id}", c.AccountID, -1)
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("Invalid endpoint URL '%s': %v", endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf(
+			"Invalid endpoint URL '%s': wanted a scheme and host",
+			endpoint,
+		)
+	}
+	params := u.Query()
+	params.Set("nrql", nrql)
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// `RequestURL()` returns the URL the client requests to execute `q`, e.g. to
+// debug region or account problems with curl. The query key isn't in it; it's
+// sent in the `X-Query-Key` header.
+func (c Client) RequestURL(q Query) (string, error) {
+	return c.RequestURLRaw(q.String())
+}
+
+// `RequestURLRaw()` is like `RequestURL()`, but for a verbatim NRQL
+// statement.
+func (c Client) RequestURLRaw(nrql string) (string, error) {
+	return c.requestURL(nrql)
+}
+
+// `do()` issues the HTTP request for `nrql`, returning the response body and
+// a description of the response (zero if there was no response).
+func (c Client) do(ctx context.Context, nrql string) ([]byte, Response, error) {
+	u, err := c.requestURL(nrql)
+	if err != nil {
+		return nil, Response{}, err
+	}
+
+	// Build a new request
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, Response{}, err
+	}
 
 	// Set the requisite headers
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("X-Query-Key", queryKey)
+	req.Header.Set("X-Query-Key", c.QueryKey)
+	req.Header.Set("User-Agent", userAgentOr(c.UserAgent))
 
 	// Dispatch the request
-	rsp, err := http.DefaultClient.Do(req)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	rsp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, Response{}, transportError{err}
 	}
 	defer rsp.Body.Close() // close the http body when done
+	response := newResponse(rsp)
 
-	// Read the body into memory
-	data, err := ioutil.ReadAll(rsp.Body)
+	// Read the body into memory, reading one byte past the limit (if any) to
+	// tell a body of exactly the limit from a longer one
+	var body io.Reader = rsp.Body
+	if c.MaxResponseSize > 0 {
+		body = io.LimitReader(rsp.Body, c.MaxResponseSize+1)
+	}
+	data, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, err
+		return data, response, err
 	}
-
-	// Check the status code
-	if rsp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"Wanted HTTP 200; got %d: %s",
-			rsp.StatusCode,
-			data,
+	if c.MaxResponseSize > 0 && int64(len(data)) > c.MaxResponseSize {
+		return nil, response, fmt.Errorf(
+			"%w: exceeded %d bytes",
+			ErrResponseTooLarge,
+			c.MaxResponseSize,
 		)
 	}
 
-	return unmarshalPayload(data)
+	// Check the status code, and the body of a 200 response for an error in
+	// place of a payload, so that neither is cached
+	apiErr := &APIError{
+		StatusCode: rsp.StatusCode,
+		Message:    errorMessage(data),
+		Body:       data,
+	}
+	if rsp.StatusCode == http.StatusOK && apiErr.Message == "" {
+		return data, response, nil
+	}
+	if apiErr.tooExpensive() {
+		return data, response, fmt.Errorf(
+			"%w: %w; narrow the time range or add a LIMIT",
+			ErrQueryTooExpensive,
+			apiErr,
+		)
+	}
+	return data, response, apiErr
 }
 
 func (c Client) Exec(q Query) (Payload, error) {
-	return execRaw(c.AccountID, c.QueryKey, q.String())
+	return c.ExecContext(context.Background(), q)
 }
 
 func (c Client) ExecRaw(nrql string) (Payload, error) {
-	return execRaw(c.AccountID, c.QueryKey, nrql)
+	return c.ExecRawContext(context.Background(), nrql)
+}
+
+// `ExecContext()` is like `Exec()`, but the request is aborted when `ctx` is
+// done.
+func (c Client) ExecContext(ctx context.Context, q Query) (Payload, error) {
+	return c.ExecRawContext(ctx, q.String())
+}
+
+// `ExecRawContext()` is like `ExecRaw()`, but the request is aborted when
+// `ctx` is done.
+func (c Client) ExecRawContext(ctx context.Context, nrql string) (Payload, error) {
+	return c.execRaw(ctx, nrql)
+}
+
+// `ExecTimeout()` is like `Exec()`, but it gives up after `d` (if `d` is
+// positive), e.g. so that a hung request can't stall a cron job forever. The
+// error in that case satisfies `errors.Is(err, context.DeadlineExceeded)`.
+func (c Client) ExecTimeout(q Query, d time.Duration) (Payload, error) {
+	return c.ExecRawTimeout(q.String(), d)
+}
+
+// `ExecRawTimeout()` is like `ExecTimeout()`, but for a verbatim NRQL
+// statement.
+func (c Client) ExecRawTimeout(nrql string, d time.Duration) (Payload, error) {
+	if d <= 0 {
+		return c.ExecRaw(nrql)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	p, err := c.ExecRawContext(ctx, nrql)
+	return p, timeoutError(ctx, d, err)
+}
+
+// `timeoutError()` replaces `err` with a clearer one if it's due to `ctx`
+// (whose timeout is `d`) expiring. The cause is kept for `errors.Is()`.
+func timeoutError(ctx context.Context, d time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Query timed out after %v: %w", d, ctx.Err())
+	}
+	return err
+}
+
+// `ExecRawBytes()` is like `ExecRaw()`, but it also returns the response body
+// as received from New Relic. The body is returned even if it couldn't be
+// decoded into a `Payload`, which is useful for diagnosing (or handling
+// oneself) response shapes this package doesn't understand.
+func (c Client) ExecRawBytes(nrql string) ([]byte, Payload, error) {
+	return c.ExecRawBytesContext(context.Background(), nrql)
+}
+
+// `ExecRawBytesContext()` is like `ExecRawBytes()`, but the request is
+// aborted when `ctx` is done.
+func (c Client) ExecRawBytesContext(
+	ctx context.Context,
+	nrql string,
+) ([]byte, Payload, error) {
+	data, _, err := c.fetch(ctx, nrql)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := c.decode(data)
+	return data, p, err
+}
+
+// `ExecRawResponse()` is like `ExecRaw()`, but it also describes the HTTP
+// response the payload came from, e.g. to log New Relic's request ID or to
+// back off before the query quota runs out. The response is returned even if
+// the query failed, as long as New Relic answered.
+func (c Client) ExecRawResponse(nrql string) (Payload, Response, error) {
+	return c.ExecRawResponseContext(context.Background(), nrql)
+}
+
+// `ExecRawResponseContext()` is like `ExecRawResponse()`, but the request is
+// aborted when `ctx` is done.
+func (c Client) ExecRawResponseContext(
+	ctx context.Context,
+	nrql string,
+) (Payload, Response, error) {
+	data, rsp, err := c.fetch(ctx, nrql)
+	if err != nil {
+		return nil, rsp, err
+	}
+	p, err := c.decode(data)
+	return p, rsp, err
+}
+
+// `Describe()` runs `q` and reports the kind of payload it produced and its
+// number of rows, without the caller having to handle the rows themselves.
+// This is useful for sizing an extract before committing to it; note that the
+// query is still executed in full (NRQL has no way to count results without
+// producing them).
+func (c Client) Describe(q Query) (PayloadKind, int, error) {
+	return c.DescribeRaw(q.String())
+}
+
+// `DescribeRaw()` is like `Describe()`, but for a verbatim NRQL statement.
+func (c Client) DescribeRaw(nrql string) (PayloadKind, int, error) {
+	return c.DescribeRawContext(context.Background(), nrql)
+}
+
+// `DescribeRawContext()` is like `DescribeRaw()`, but the request is aborted
+// when `ctx` is done.
+func (c Client) DescribeRawContext(
+	ctx context.Context,
+	nrql string,
+) (PayloadKind, int, error) {
+	p, err := c.ExecRawContext(ctx, nrql)
+	if err != nil {
+		return PayloadKindUnknown, 0, err
+	}
+	rows, err := p.Rows()
+	if err != nil {
+		return p.Kind(), 0, err
+	}
+	return p.Kind(), len(rows), nil
 }
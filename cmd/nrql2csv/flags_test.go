@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+)
+
+// `parseArgs()` runs `parseFlags()` on the command line `args`, with stdin
+// piped (and empty) rather than a terminal.
+func parseArgs(t *testing.T, args ...string) options {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	oldArgs, oldFlags, oldStdin := os.Args, flag.CommandLine, os.Stdin
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine, os.Stdin = oldArgs, oldFlags, oldStdin
+		r.Close()
+	})
+	os.Args = append([]string{"nrql2csv"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	os.Stdin = r
+	return parseFlags()
+}
+
+func TestParseFlagsDiscovery(t *testing.T) {
+	if opts := parseArgs(t, "--list-tables"); !opts.listTables {
+		t.Error("wanted --list-tables to be set")
+	}
+
+	opts := parseArgs(t, "--describe-table", "Transaction")
+	if opts.describeTable != "Transaction" {
+		t.Errorf(
+			"wanted --describe-table Transaction; got %q",
+			opts.describeTable,
+		)
+	}
+	if opts.raw != "" {
+		t.Errorf("wanted no query; got %q", opts.raw)
+	}
+}
+
+func TestParseFlagsDiscoveryRejectsQueries(t *testing.T) {
+	// parseFlags() exits on bad flags, so each case runs in a subprocess
+	if args := os.Getenv("NRQL2CSV_TEST_ARGS"); args != "" {
+		parseArgs(t, strings.Fields(args)...)
+		return
+	}
+
+	for _, args := range []string{
+		"--list-tables --from Transaction",
+		"--list-tables --since=1h",
+		"--describe-table Transaction --raw=SELECT",
+		"--describe-table Transaction --stdin",
+	} {
+		cmd := exec.Command(
+			os.Args[0],
+			"-test.run=^TestParseFlagsDiscoveryRejectsQueries$",
+		)
+		cmd.Env = append(os.Environ(), "NRQL2CSV_TEST_ARGS="+args)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Errorf("%s: wanted it to exit with an error", args)
+		} else if !strings.Contains(string(out), "can't be combined with") {
+			t.Errorf("%s: wanted a usage error; got:\n%s", args, out)
+		}
+	}
+}
+
+func TestParseFlagsExcel(t *testing.T) {
+	opts := parseArgs(t, "--from", "Transaction", "--excel")
+	if !opts.csvOptions.UseCRLF {
+		t.Error("wanted --excel to imply --crlf")
+	}
+	if !opts.csvOptions.UTF8BOM {
+		t.Error("wanted --excel to write a byte order mark")
+	}
+
+	opts = parseArgs(t, "--from", "Transaction", "--crlf")
+	if opts.csvOptions.UTF8BOM {
+		t.Error("wanted --crlf alone to write no byte order mark")
+	}
+}
+
+func TestReadHeaderSkipsByteOrderMark(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "excel.csv")
+	data := nrql.UTF8ByteOrderMark + "host,count\r\nweb-1,3\r\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"host", "count"}; !reflect.DeepEqual(header, want) {
+		t.Errorf("wanted %q; got %q", want, header)
+	}
+}
+
+func TestParseFlagsColor(t *testing.T) {
+	// A character device, so that stdout passes for a terminal
+	tty, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	oldStdout := os.Stdout
+	os.Stdout = tty
+	defer func() { os.Stdout = oldStdout }()
+
+	for _, c := range []struct {
+		color, noColor string
+		want           bool
+	}{
+		{"auto", "", true},
+		{"auto", "1", false},
+		{"never", "", false},
+		{"always", "1", true},
+	} {
+		t.Setenv("NO_COLOR", c.noColor)
+		opts := parseArgs(t, "--from", "Transaction", "--color", c.color)
+		if opts.color != c.want {
+			t.Errorf(
+				"--color %s (NO_COLOR=%q): wanted color %v",
+				c.color,
+				c.noColor,
+				c.want,
+			)
+		}
+	}
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	nrql "github.com/ns-cweber/nrql2csv"
@@ -14,11 +27,210 @@ func trim(s string) string {
 	return strings.TrimFunc(s, unicode.IsSpace)
 }
 
-func parseFlags() (nrql.Query, []nrql.StaticColumn) {
-	var q nrql.Query
+// A formatter writes a payload to a writer; each takes whichever of the
+// options apply to it
+type formatter func(io.Writer, nrql.Payload, options) error
+
+// The supported --format values
+var formatters = map[string]formatter{
+	"csv": func(w io.Writer, p nrql.Payload, opts options) error {
+		return nrql.FormatCSVWithOptions(w, p, opts.csvOptions)
+	},
+	"json": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatJSON(w, p)
+	},
+	"jsonnested": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatJSONNested(w, p)
+	},
+	"jsonschema": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatJSONSchema(w, p)
+	},
+	"ndjson": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatNDJSON(w, p)
+	},
+	"parquet": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatParquet(w, p)
+	},
+	"table": func(w io.Writer, p nrql.Payload, opts options) error {
+		tableOptions := nrql.TableOptions{
+			MaxWidth:      opts.maxWidth,
+			ColumnFormats: opts.csvOptions.ColumnFormats,
+			Columns:       opts.csvOptions.Columns,
+			Rename:        opts.csvOptions.Rename,
+			MaxRows:       opts.csvOptions.MaxRows,
+			AddRowNumber:  opts.csvOptions.AddRowNumber,
+			Color:         opts.color,
+		}
+		if opts.groupDigits {
+			tableOptions.GroupSeparator = ","
+		}
+		return nrql.FormatTableWithOptions(w, p, tableOptions)
+	},
+	"tsv": func(w io.Writer, p nrql.Payload, opts options) error {
+		opts.csvOptions.Comma = '\t'
+		return nrql.FormatCSVWithOptions(w, p, opts.csvOptions)
+	},
+	"xlsx": func(w io.Writer, p nrql.Payload, _ options) error {
+		return nrql.FormatXLSX(w, p)
+	},
+}
+
+// The extensions of the files in --output-dir, for formats whose names
+// aren't their extensions
+var formatExtensions = map[string]string{
+	"jsonnested": ".json",
+	"jsonschema": ".json",
+	"table":      ".txt",
+}
+
+// The supported --time-unit values
+var timeUnits = map[string]nrql.ColumnFormat{
+	"auto": nrql.EpochFormat,
+	"s":    nrql.EpochSecondsFormat,
+	"ms":   nrql.EpochMillisFormat,
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The parsed command line
+type options struct {
+	query         nrql.Query
+	staticColumns []nrql.StaticColumn
+	format        formatter
+	csvOptions    nrql.CSVOptions
+
+	// The cell width limit for the table format, whether to color it, and
+	// whether to group the digits of its numbers
+	maxWidth    int
+	color       bool
+	groupDigits bool
+
+	// A verbatim NRQL statement which, if set, is run instead of `query`
+	raw string
+
+	// The path to write to; empty or "-" means stdout
+	output string
+
+	// The queries of a --queries-file, each run into its own file in
+	// `outputDir` (named by its position and `extension`), at most
+	// `concurrency` at a time
+	batch       []batchQuery
+	outputDir   string
+	extension   string
+	concurrency int
+
+	// Whether to append to `output` (checking that its header matches)
+	// rather than replace it
+	append bool
+
+	// Whether to describe the extract in a sidecar file next to `output`
+	meta bool
+
+	// The config file profile to take credentials from
+	profile string
+
+	// Whether to append the overall total and the unknown group
+	// respectively to faceted results
+	includeTotal   bool
+	includeUnknown bool
+
+	// Whether to flatten nested objects into dotted-path columns, and how
+	// deep
+	flatten      bool
+	flattenDepth int
+
+	// The column whose lists (e.g., of uniques()) to explode into a row per
+	// element; empty for none
+	explode string
+
+	// The column whose values to pivot into columns of their own, holding
+	// the values of `pivotValue` (the last other column, if empty); empty for
+	// no pivot
+	pivot      string
+	pivotValue string
+
+	// Whether to print the request URL instead of running the query
+	printURL bool
+
+	// Whether to print the payload kind and row count instead of the rows
+	describe bool
+
+	// Whether to list the account's event types, or the event type whose
+	// attributes to list, instead of running a query
+	listTables    bool
+	describeTable string
+
+	// Whether to print just the row count (of facets, for faceted results)
+	// instead of the rows
+	count bool
+
+	// Whether to page through every result rather than stopping at the
+	// limit
+	all bool
+
+	// Whether to leave out the progress of --all, as for a batch's queries,
+	// which run concurrently and would overwrite each other's
+	noProgress bool
+
+	// Whether to log each request to stderr
+	verbose bool
+
+	// How long to wait for the results before giving up; zero means forever
+	timeout time.Duration
+
+	// The largest response to accept, in bytes; zero means no limit
+	maxResponseSize int64
+
+	// If positive, the query is run once per bucket of this long across its
+	// SINCE...UNTIL range, each into its own file
+	bucket time.Duration
+}
+
+// A query from a --queries-file: raw NRQL, or a query saved as JSON
+type batchQuery struct {
+	// The query's line in the file, for error messages
+	line int
+
+	raw   string
+	query nrql.Query
+}
+
+// `statement()` returns the NRQL to execute.
+func (opts options) statement() string {
+	if opts.raw != "" {
+		return opts.raw
+	}
+	return opts.query.String()
+}
+
+func parseFlags() options {
+	var opts options
+	q := &opts.query
 	var columns string
 	var static string
+	var format string
+	var timeColumns string
+	var timeUnit string
+	var boolFormat string
+	var floatFormat string
+	var arrayFormat string
+	var last string
+	var bucket string
+	var outputColumns string
+	var rename string
 	var dry bool
+	var stdin bool
+	var queryFile string
+	var queriesFile string
+	var color string
+	var excel bool
 	flag.StringVar(
 		&columns,
 		"select",
@@ -28,8 +240,22 @@ func parseFlags() (nrql.Query, []nrql.StaticColumn) {
 	flag.StringVar(&q.Table, "from", "", "[REQUIRED] the table to query from")
 	flag.StringVar(&q.Where, "where", "", "[OPTIONAL] the WHERE clause")
 	flag.StringVar(&q.Since, "since", "", "[OPTIONAL] the SINCE clause")
+	flag.StringVar(
+		&last,
+		"last",
+		"",
+		"[OPTIONAL] query the last this long (e.g., '30m', '24h' or '7d'); "+
+			"shorthand for --since '30 minutes ago'",
+	)
 	flag.StringVar(&q.Until, "until", "", "[OPTIONAL] the UNTIL clause")
 	flag.StringVar(&q.Facet, "facet", "", "[OPTIONAL] the FACET column")
+	flag.IntVar(
+		&q.FacetLimit,
+		"facet-limit",
+		0,
+		"[OPTIONAL] the most facets to return, separately from --limit "+
+			"(requires --facet)",
+	)
 	flag.StringVar(
 		&static,
 		"static",
@@ -37,22 +263,692 @@ func parseFlags() (nrql.Query, []nrql.StaticColumn) {
 		"[OPTIONAL] extra fixed-value columns (e.g., 'col1=val1,col2=val2')",
 	)
 	flag.IntVar(&q.Limit, "limit", -1, "[OPTIONAL] the LIMIT column")
+	flag.BoolVar(
+		&q.LimitMax,
+		"limit-max",
+		false,
+		"[OPTIONAL] LIMIT MAX (can't be combined with --limit)",
+	)
+	flag.StringVar(
+		&q.TimeSeries,
+		"timeseries",
+		"",
+		"[OPTIONAL] the TIMESERIES bucket size (e.g., '1 minute' or 'AUTO')",
+	)
+	flag.StringVar(
+		&q.SlideBy,
+		"slide-by",
+		"",
+		"[OPTIONAL] the SLIDE BY interval (requires --timeseries)",
+	)
+	flag.BoolVar(
+		&q.Extrapolate,
+		"extrapolate",
+		false,
+		"[OPTIONAL] EXTRAPOLATE sampled results to estimate true totals",
+	)
 	flag.BoolVar(&dry, "dry", false, "[OPTIONAL] Prints the query")
+	flag.BoolVar(
+		&opts.printURL,
+		"print-url",
+		false,
+		"[OPTIONAL] print the URL which would be requested (for curl; the "+
+			"query key goes in an X-Query-Key header) instead of running the "+
+			"query",
+	)
+	flag.BoolVar(
+		&opts.verbose,
+		"verbose",
+		false,
+		"[OPTIONAL] log the NRQL, HTTP status, response size and timing of "+
+			"each request to stderr",
+	)
+	flag.DurationVar(
+		&opts.timeout,
+		"timeout",
+		0,
+		"[OPTIONAL] give up if the results take longer than this (e.g., "+
+			"'30s'; default no timeout)",
+	)
+	flag.Int64Var(
+		&opts.maxResponseSize,
+		"max-response-size",
+		0,
+		"[OPTIONAL] give up on responses larger than this many bytes "+
+			"(default no limit)",
+	)
+	flag.StringVar(
+		&bucket,
+		"bucket",
+		"",
+		"[OPTIONAL] run the query once per bucket of this long (e.g., '1d') "+
+			"from SINCE to UNTIL, writing each to the --output file with the "+
+			"bucket's start in its name (e.g., 'out-2024-01-01.csv')",
+	)
+	flag.BoolVar(
+		&opts.all,
+		"all",
+		false,
+		"[OPTIONAL] fetch every result, paging past the "+
+			strconv.Itoa(nrql.MaxPageSize)+"-row limit (for queries of "+
+			"events, not aggregations); --limit, if set, caps the total",
+	)
+	flag.BoolVar(
+		&opts.flatten,
+		"flatten",
+		false,
+		"[OPTIONAL] flatten nested objects in attributes into dotted-path "+
+			"columns (e.g., 'user.id')",
+	)
+	flag.IntVar(
+		&opts.flattenDepth,
+		"flatten-depth",
+		nrql.DefaultFlattenDepth,
+		"[OPTIONAL] the deepest nesting --flatten expands",
+	)
+	flag.StringVar(
+		&opts.explode,
+		"explode",
+		"",
+		"[OPTIONAL] a column of lists (e.g., from uniques()) to explode into "+
+			"one row per element",
+	)
+	flag.StringVar(
+		&opts.pivot,
+		"pivot",
+		"",
+		"[OPTIONAL] a column (e.g., a facet) whose values to pivot into "+
+			"columns of their own, merging the rows which agree on the "+
+			"other columns (reads every row into memory first)",
+	)
+	flag.StringVar(
+		&opts.pivotValue,
+		"pivot-value",
+		"",
+		"[OPTIONAL] the column whose values fill the --pivot columns "+
+			"(default the last other column)",
+	)
+	flag.BoolVar(
+		&opts.describe,
+		"describe",
+		false,
+		"[OPTIONAL] print the kind of result (basic, facet, etc.) and its "+
+			"row count instead of the results",
+	)
+	flag.BoolVar(
+		&opts.listTables,
+		"list-tables",
+		false,
+		"[OPTIONAL] list the account's event types instead of running a "+
+			"query",
+	)
+	flag.StringVar(
+		&opts.describeTable,
+		"describe-table",
+		"",
+		"[OPTIONAL] list the attributes of this event type instead of running "+
+			"a query",
+	)
+	flag.BoolVar(
+		&opts.count,
+		"count",
+		false,
+		"[OPTIONAL] print just the number of rows (facets, for faceted "+
+			"results) instead of the results",
+	)
+	flag.BoolVar(
+		&opts.includeTotal,
+		"include-total",
+		false,
+		"[OPTIONAL] append a '"+nrql.DefaultTotalLabel+"' row with the "+
+			"overall total to faceted results",
+	)
+	flag.BoolVar(
+		&opts.includeUnknown,
+		"include-unknown",
+		false,
+		"[OPTIONAL] append a '"+nrql.DefaultUnknownLabel+"' row for events "+
+			"lacking the facet attribute to faceted results",
+	)
+	flag.StringVar(
+		&opts.raw,
+		"raw",
+		"",
+		"[OPTIONAL] a complete NRQL query to run verbatim (can't be combined "+
+			"with the query-building flags)",
+	)
+	flag.BoolVar(
+		&stdin,
+		"stdin",
+		false,
+		"[OPTIONAL] read a raw NRQL query from stdin (implied when --from is "+
+			"omitted and stdin isn't a terminal)",
+	)
+	flag.StringVar(
+		&queryFile,
+		"query-file",
+		"",
+		"[OPTIONAL] a query saved as JSON to run (can't be combined with the "+
+			"query-building flags)",
+	)
+	flag.StringVar(
+		&queriesFile,
+		"queries-file",
+		"",
+		"[OPTIONAL] a file of queries (raw NRQL, or JSON as for "+
+			"--query-file) to run, one per line, each into its own file in "+
+			"--output-dir; blank lines and lines starting with # are skipped",
+	)
+	flag.StringVar(
+		&opts.outputDir,
+		"output-dir",
+		"",
+		"[OPTIONAL] the directory to write the results of --queries-file to, "+
+			"as 1.csv, 2.csv, etc. (or the --format's extension)",
+	)
+	flag.IntVar(
+		&opts.concurrency,
+		"concurrency",
+		1,
+		"[OPTIONAL] the most queries from --queries-file to run at once",
+	)
+	flag.StringVar(
+		&opts.output,
+		"output",
+		"",
+		"[OPTIONAL] the file to write to (default stdout)",
+	)
+	flag.BoolVar(
+		&opts.append,
+		"append",
+		false,
+		"[OPTIONAL] append the rows to the --output file, whose header must "+
+			"match, rather than replacing it (CSV and TSV only)",
+	)
+	flag.BoolVar(
+		&opts.meta,
+		"meta",
+		false,
+		"[OPTIONAL] also write the query, time, account, row count and kind "+
+			"of result to a .meta.json file next to the --output file",
+	)
+	flag.StringVar(
+		&opts.profile,
+		"profile",
+		os.Getenv("NEW_RELIC_PROFILE"),
+		"[OPTIONAL] the ~/"+nrql.ConfigFileName+" profile to take "+
+			"credentials from (default $NEW_RELIC_PROFILE or 'default')",
+	)
+	flag.StringVar(
+		&format,
+		"format",
+		"",
+		"[OPTIONAL] the output format ("+strings.Join(formatNames(), ", ")+
+			") (default table on a terminal, csv otherwise)",
+	)
+	flag.StringVar(
+		&color,
+		"color",
+		"auto",
+		"[OPTIONAL] embolden table headers (auto, always, never); auto means "+
+			"on a terminal, unless $NO_COLOR is set",
+	)
+	flag.IntVar(
+		&opts.maxWidth,
+		"max-width",
+		nrql.DefaultTableMaxWidth,
+		"[OPTIONAL] truncate table cells wider than this (negative for no "+
+			"limit)",
+	)
+	flag.BoolVar(
+		&opts.groupDigits,
+		"group-digits",
+		false,
+		"[OPTIONAL] separate the thousands of numbers with commas (e.g., "+
+			"'1,234,567'; table only)",
+	)
+	flag.StringVar(
+		&timeColumns,
+		"time-columns",
+		"",
+		"[OPTIONAL] comma-delineated columns of epoch timestamps to render "+
+			"as RFC3339 (CSV, TSV and table only)",
+	)
+	flag.StringVar(
+		&timeUnit,
+		"time-unit",
+		"auto",
+		"[OPTIONAL] the unit of the --time-columns (auto, s, ms)",
+	)
+	flag.StringVar(
+		&boolFormat,
+		"bool-format",
+		"truefalse",
+		"[OPTIONAL] how to render booleans in CSV and TSV (truefalse, 10 "+
+			"or TF for TRUE/FALSE)",
+	)
+	flag.StringVar(
+		&floatFormat,
+		"float-format",
+		"fixed",
+		"[OPTIONAL] the notation of floats in CSV and TSV (fixed, "+
+			"scientific, auto)",
+	)
+	flag.IntVar(
+		&opts.csvOptions.FloatPrecision,
+		"float-precision",
+		0,
+		"[OPTIONAL] the digits after the decimal point (significant digits "+
+			"for --float-format auto) of floats in CSV and TSV (default as "+
+			"many as needed)",
+	)
+	flag.BoolVar(
+		&opts.csvOptions.JSONComplexCells,
+		"json-cells",
+		false,
+		"[OPTIONAL] render objects in CSV and TSV cells as JSON",
+	)
+	flag.StringVar(
+		&arrayFormat,
+		"array-format",
+		"json",
+		"[OPTIONAL] how to render arrays in CSV and TSV cells (json, or "+
+			"joined by --array-separator)",
+	)
+	flag.StringVar(
+		&opts.csvOptions.ArraySeparator,
+		"array-separator",
+		nrql.DefaultArraySeparator,
+		"[OPTIONAL] the separator of array elements for --array-format "+
+			"joined",
+	)
+	flag.BoolVar(
+		&opts.csvOptions.QuoteAll,
+		"quote-all",
+		false,
+		"[OPTIONAL] quote every CSV and TSV field, not just those which need "+
+			"it",
+	)
+	flag.BoolVar(
+		&opts.csvOptions.UseCRLF,
+		"crlf",
+		false,
+		"[OPTIONAL] end CSV and TSV lines with CRLF (for Windows tools)",
+	)
+	flag.BoolVar(
+		&excel,
+		"excel",
+		false,
+		"[OPTIONAL] write CSV and TSV for Excel: with --crlf, and a UTF-8 "+
+			"byte order mark so that non-ASCII text isn't garbled",
+	)
+	flag.StringVar(
+		&outputColumns,
+		"output-columns",
+		"",
+		"[OPTIONAL] comma-delineated columns to write, in order, out of "+
+			"those the query returns (CSV, TSV and table only)",
+	)
+	flag.StringVar(
+		&rename,
+		"rename",
+		"",
+		"[OPTIONAL] friendlier names for columns in the header (e.g., "+
+			"'count(*)=Total,host=Host'; CSV, TSV and table only)",
+	)
+	flag.IntVar(
+		&opts.csvOptions.MaxRows,
+		"head",
+		0,
+		"[OPTIONAL] only write the first N rows, without changing the query "+
+			"(CSV, TSV and table only)",
+	)
+	flag.BoolVar(
+		&opts.csvOptions.AddRowNumber,
+		"row-number",
+		false,
+		"[OPTIONAL] prepend a '"+nrql.DefaultRowNumberHeader+"' column "+
+			"numbering the rows from 1 (CSV, TSV and table only)",
+	)
 	flag.Parse()
 
+	if excel {
+		opts.csvOptions.UseCRLF = true
+		opts.csvOptions.UTF8BOM = true
+	}
+
+	// Warnings (e.g., about malformed rows) go to stderr, away from the output
+	opts.csvOptions.Logger = log.New(os.Stderr, "", 0)
+
+	// Tables (and color) are for people; pipes and files get CSV
+	toTerminal := (opts.output == "" || opts.output == "-") &&
+		opts.outputDir == "" &&
+		isTerminal(os.Stdout)
+	if format == "" {
+		format = "csv"
+		if toTerminal {
+			format = "table"
+		}
+	}
+
+	switch color {
+	case "always":
+		opts.color = true
+	case "never":
+	case "auto":
+		// https://no-color.org/
+		opts.color = toTerminal && os.Getenv("NO_COLOR") == ""
+	default:
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --color '%s'; wanted one of: auto, always, never\n",
+			color,
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if opts.append {
+		switch {
+		case opts.output == "" || opts.output == "-":
+			fmt.Fprintln(os.Stderr, "--append requires an --output file")
+			flag.Usage()
+			os.Exit(-1)
+		case format == "tsv":
+			// The existing header is read with the same delimiter
+			opts.csvOptions.Comma = '\t'
+		case format != "csv":
+			fmt.Fprintf(
+				os.Stderr,
+				"--append only works with --format csv or tsv, not '%s'\n",
+				format,
+			)
+			flag.Usage()
+			os.Exit(-1)
+		}
+	}
+
+	var ok bool
+	if opts.format, ok = formatters[format]; !ok {
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --format '%s'; wanted one of: %s\n",
+			format,
+			strings.Join(formatNames(), ", "),
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if opts.extension, ok = formatExtensions[format]; !ok {
+		opts.extension = "." + format
+	}
+
+	timeFormat, ok := timeUnits[timeUnit]
+	if !ok {
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --time-unit '%s'; wanted one of: auto, s, ms\n",
+			timeUnit,
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	bf, err := nrql.ParseBoolFormat(boolFormat)
+	if err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --bool-format '%s'; wanted one of: truefalse, 10, TF\n",
+			boolFormat,
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	opts.csvOptions.BoolFormat = bf
+
+	ff, err := nrql.ParseFloatFormat(floatFormat)
+	if err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --float-format '%s'; wanted one of: fixed, scientific, "+
+				"auto\n",
+			floatFormat,
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	opts.csvOptions.FloatFormat = ff
+
+	af, err := nrql.ParseArrayFormat(arrayFormat)
+	if err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"Unknown --array-format '%s'; wanted one of: json, joined\n",
+			arrayFormat,
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	opts.csvOptions.ArrayFormat = af
+
+	if timeColumns != "" {
+		opts.csvOptions.ColumnFormats = map[string]nrql.ColumnFormat{}
+		for _, col := range strings.Split(timeColumns, ",") {
+			opts.csvOptions.ColumnFormats[trim(col)] = timeFormat
+		}
+	}
+
+	if outputColumns != "" {
+		for _, col := range splitColumns(outputColumns) {
+			opts.csvOptions.Columns = append(opts.csvOptions.Columns, trim(col))
+		}
+	}
+
 	if columns != "*" && columns != "" {
-		for _, col := range strings.Split(columns, ",") {
+		for _, col := range splitColumns(columns) {
 			q.Columns = append(q.Columns, trim(col))
 		}
 	}
 
-	if q.Table == "" {
+	if q.LimitMax && isFlagSet("limit") {
+		fmt.Fprintln(os.Stderr, "--limit and --limit-max are mutually exclusive")
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if queriesFile != "" {
+		if opts.outputDir == "" {
+			fmt.Fprintln(os.Stderr, "--queries-file requires an --output-dir")
+			flag.Usage()
+			os.Exit(-1)
+		}
+		for _, name := range []string{
+			"output",
+			"bucket",
+			"count",
+			"describe",
+			"print-url",
+			"list-tables",
+			"describe-table",
+		} {
+			if isFlagSet(name) {
+				fmt.Fprintf(
+					os.Stderr,
+					"--queries-file and --%s are mutually exclusive\n",
+					name,
+				)
+				flag.Usage()
+				os.Exit(-1)
+			}
+		}
+		if opts.concurrency < 1 {
+			abortf(
+				"--concurrency must be positive; got %d\n",
+				opts.concurrency,
+			)
+		}
+	} else if opts.outputDir != "" {
+		fmt.Fprintln(os.Stderr, "--output-dir requires a --queries-file")
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	// With --queries-file, each query's results get a sidecar file
+	if opts.meta && opts.outputDir == "" &&
+		(opts.output == "" || opts.output == "-") {
+		fmt.Fprintln(os.Stderr, "--meta requires an --output file")
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if opts.listTables && opts.describeTable != "" {
+		fmt.Fprintln(
+			os.Stderr,
+			"--list-tables and --describe-table are mutually exclusive",
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if opts.count {
+		for _, name := range []string{"format", "describe", "output"} {
+			if isFlagSet(name) {
+				fmt.Fprintf(
+					os.Stderr,
+					"--count and --%s are mutually exclusive\n",
+					name,
+				)
+				flag.Usage()
+				os.Exit(-1)
+			}
+		}
+	}
+
+	if bucket != "" {
+		if opts.output == "" || opts.output == "-" {
+			fmt.Fprintln(os.Stderr, "--bucket requires an --output file")
+			flag.Usage()
+			os.Exit(-1)
+		}
+		d, err := nrql.ParseDuration(bucket)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("Bucket size must be positive; got %v", d)
+		}
+		if err != nil {
+			abortf("Error in --bucket: %v\n", err)
+		}
+		opts.bucket = d
+	}
+
+	if last != "" {
+		if q.Since != "" {
+			fmt.Fprintln(os.Stderr, "--since and --last are mutually exclusive")
+			flag.Usage()
+			os.Exit(-1)
+		}
+		since, err := nrql.ParseLast(last)
+		if err != nil {
+			abortf("Error in --last: %v\n", err)
+		}
+		q.Since = since
+	}
+
+	// The alternatives to building the query from flags
+	var sources []string
+	if opts.raw != "" {
+		sources = append(sources, "--raw")
+	}
+	if stdin {
+		sources = append(sources, "--stdin")
+	}
+	if queryFile != "" {
+		sources = append(sources, "--query-file")
+	}
+	if queriesFile != "" {
+		sources = append(sources, "--queries-file")
+	}
+	if len(sources) > 1 {
+		fmt.Fprintln(
+			os.Stderr,
+			strings.Join(sources, " and "),
+			"are mutually exclusive",
+		)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	// Discovery doesn't run a query, so it takes none
+	discovery := opts.listTables || opts.describeTable != ""
+	if discovery {
+		if set := append(sources, queryFlagsSet()...); len(set) > 0 {
+			name := "--list-tables"
+			if opts.describeTable != "" {
+				name = "--describe-table"
+			}
+			fmt.Fprintf(
+				os.Stderr,
+				"%s can't be combined with %s\n",
+				name,
+				strings.Join(set, ", "),
+			)
+			flag.Usage()
+			os.Exit(-1)
+		}
+	}
+
+	if len(sources) > 0 {
+		if set := queryFlagsSet(); len(set) > 0 {
+			fmt.Fprintf(
+				os.Stderr,
+				"%s can't be combined with %s\n",
+				sources[0],
+				strings.Join(set, ", "),
+			)
+			flag.Usage()
+			os.Exit(-1)
+		}
+	}
+
+	switch {
+	case discovery:
+		// There's no query to find
+	case opts.raw != "":
+		// The query is used verbatim
+	case queryFile != "":
+		data, err := ioutil.ReadFile(queryFile)
+		if err != nil {
+			abort("Error reading query file:", err)
+		}
+		if opts.query, err = nrql.ParseQueryJSON(data); err != nil {
+			abortf("Error in query file '%s': %v\n", queryFile, err)
+		}
+	case queriesFile != "":
+		var err error
+		if opts.batch, err = readQueries(queriesFile); err != nil {
+			abortf("Error in queries file '%s': %v\n", queriesFile, err)
+		}
+	case stdin || (q.Table == "" && !isTerminal(os.Stdin)):
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			abort("Error reading query from stdin:", err)
+		}
+		if opts.raw = strings.TrimRightFunc(
+			string(data),
+			unicode.IsSpace,
+		); trim(opts.raw) == "" {
+			abort("Empty query on stdin")
+		}
+	case q.Table == "":
 		fmt.Fprintln(os.Stderr, "Missing --from flag")
 		flag.Usage()
 		os.Exit(-1)
 	}
 
-	var staticColumns []nrql.StaticColumn
+	if opts.raw == "" && opts.batch == nil && !discovery {
+		if err := q.Validate(); err != nil {
+			abort(err)
+		}
+	}
+
 	if static != "" {
 		for _, column := range strings.Split(static, ",") {
 			if idx := strings.IndexRune(column, '='); idx >= 0 {
@@ -63,7 +959,7 @@ func parseFlags() (nrql.Query, []nrql.StaticColumn) {
 
 				// it's ok to have an empty value, but not an empty name
 				if sc.Name != "" {
-					staticColumns = append(staticColumns, sc)
+					opts.staticColumns = append(opts.staticColumns, sc)
 					continue
 				}
 			}
@@ -74,12 +970,111 @@ func parseFlags() (nrql.Query, []nrql.StaticColumn) {
 		}
 	}
 
+	if rename != "" {
+		opts.csvOptions.Rename = map[string]string{}
+		for _, pair := range splitColumns(rename) {
+			idx := strings.IndexRune(pair, '=')
+			if idx < 0 || trim(pair[:idx]) == "" {
+				fmt.Fprintln(os.Stderr, "Malformed --rename:", pair)
+				flag.Usage()
+				os.Exit(-1)
+			}
+			opts.csvOptions.Rename[trim(pair[:idx])] = trim(pair[idx+1:])
+		}
+	}
+
 	if dry {
-		fmt.Println(q.String())
+		fmt.Println(opts.statement())
 		os.Exit(0)
 	}
 
-	return q, staticColumns
+	return opts
+}
+
+// `splitColumns()` splits a --select list on the commas between columns, but
+// not those inside parentheses or quotes, so that (for example)
+// "percentile(duration, 95) AS 'p95, ms', name" yields two columns. Aliases
+// are passed through verbatim.
+func splitColumns(s string) []string {
+	var columns []string
+	var depth int
+	var quote rune
+	var escaped bool
+	start := 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			columns = append(columns, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(columns, s[start:])
+}
+
+// The flags which build up `options.query`; these are meaningless when the
+// query is supplied verbatim
+var queryFlags = map[string]bool{
+	"select":      true,
+	"from":        true,
+	"where":       true,
+	"since":       true,
+	"last":        true,
+	"until":       true,
+	"facet":       true,
+	"facet-limit": true,
+	"limit":       true,
+	"limit-max":   true,
+	"timeseries":  true,
+	"slide-by":    true,
+	"extrapolate": true,
+}
+
+// `queryFlagsSet()` returns the query-building flags that were explicitly
+// passed on the command line.
+func queryFlagsSet() []string {
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		if queryFlags[f.Name] {
+			set = append(set, "--"+f.Name)
+		}
+	})
+	return set
+}
+
+// `isFlagSet()` returns true if the flag `name` was explicitly passed on the
+// command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// `isTerminal()` returns true if `f` is a terminal (as opposed to a pipe or a
+// regular file).
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 func abort(v ...interface{}) {
@@ -92,34 +1087,532 @@ func abortf(format string, v ...interface{}) {
 	os.Exit(-1)
 }
 
+// `queryError()` returns the error for `statement`, saying so plainly if it
+// was because --timeout expired.
+func queryError(
+	ctx context.Context,
+	opts options,
+	statement string,
+	err error,
+) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf(
+			"Query '%s' timed out after %v (see --timeout)",
+			statement,
+			opts.timeout,
+		)
+	}
+	return fmt.Errorf("Error for query '%s': %v", statement, err)
+}
+
+// `writeOutput()` calls `write` with a writer for `path` (or stdout, if
+// `path` is empty or "-"). Files are written to a temporary file in the same
+// directory and renamed into place only if `write` succeeds, so a failure
+// never leaves a truncated or empty file at `path`.
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "" || path == "-" {
+		return write(os.Stdout)
+	}
+
+	tmp, err := ioutil.TempFile(
+		filepath.Dir(path),
+		"."+filepath.Base(path)+".tmp",
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Temp files are created with 0600; give the output the usual
+	// permissions
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// `readHeader()` returns the header row of the delimited file at `path`, or
+// nil if the file is missing or empty (in which case appending to it writes
+// the header too).
+func readHeader(path string, comma rune) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Skip the byte order mark of a file written with --excel, which would
+	// otherwise be part of the first column's name
+	br := bufio.NewReader(f)
+	bom := nrql.UTF8ByteOrderMark
+	if prefix, _ := br.Peek(len(bom)); string(prefix) == bom {
+		br.Discard(len(bom))
+	}
+	r := csv.NewReader(br)
+	if comma != 0 {
+		r.Comma = comma
+	}
+	r.FieldsPerRecord = -1 // only the first record is read
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+// `appendOutput()` is like `writeOutput()`, but it appends to the file at
+// `path` (creating it if need be). The output is rendered in full first, so a
+// failure (e.g., a header mismatch) leaves the file as it was.
+func appendOutput(path string, write func(io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// `execAll()` fetches every page of the query. Progress is reported on stderr
+// if it's a terminal (and not `opts.noProgress`), so it never gets mixed up
+// with the output.
+func execAll(
+	ctx context.Context,
+	client nrql.Client,
+	opts options,
+) (nrql.Payload, error) {
+	q := opts.query
+	if opts.raw != "" {
+		var err error
+		if q, err = nrql.ParseQuery(opts.raw); err != nil {
+			return nil, err
+		}
+	}
+	if isTerminal(os.Stderr) && !opts.noProgress {
+		client.OnPage = func(page, rows int) {
+			fmt.Fprintf(os.Stderr, "\rFetched %d rows (page %d)", rows, page)
+		}
+		defer fmt.Fprintln(os.Stderr)
+	}
+	return client.ExecAllContext(ctx, q)
+}
+
 func main() {
 	// Parse the command line flags into a query structure
-	q, staticColumns := parseFlags()
+	opts := parseFlags()
+
+	// Only the account and region go in the URL, so the query key isn't
+	// required (which helps when debugging credentials)
+	if opts.printURL {
+		profile, err := nrql.LoadProfile(opts.profile)
+		if err != nil {
+			abort("Error loading profile:", err)
+		}
+		u, err := profile.Client().RequestURLRaw(opts.statement())
+		if err != nil {
+			abort(err)
+		}
+		fmt.Println(u)
+		return
+	}
+
+	// Resolve the credentials from the config file and the environment, and
+	// make sure we have the account ID and query key
+	client, err := nrql.LoadClient(
+		opts.profile,
+		nrql.WithMaxResponseSize(opts.maxResponseSize),
+	)
+	if err != nil {
+		abort(err)
+	}
+	if opts.verbose {
+		// Only the NRQL is logged, never the credentials
+		client.OnRequest = func(nrql string) {
+			fmt.Fprintln(os.Stderr, "Executing query:", nrql)
+		}
+		client.OnResponse = func(
+			nrql string,
+			status int,
+			d time.Duration,
+			n int,
+		) {
+			fmt.Fprintf(os.Stderr, "HTTP %d, %d bytes in %v\n", status, n, d)
+		}
+	}
 
-	// Make sure we have the account ID
-	accountID := os.Getenv("NEW_RELIC_ACCOUNT_ID")
-	if accountID == "" {
-		abort(os.Stderr, "Missing $NEW_RELIC_ACCOUNT_ID")
+	if opts.batch != nil {
+		runBatch(*client, opts)
+		return
 	}
 
-	// Make sure we have the query key
-	// (https://docs.newrelic.com/docs/insights/export-insights-data/export-api/query-insights-event-data-api#register)
-	queryKey := os.Getenv("NEW_RELIC_QUERY_KEY")
-	if queryKey == "" {
-		abort("Missing $NEW_RELIC_QUERY_KEY")
+	// The timeout covers every request, including all of the pages of --all
+	ctx := context.Background()
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
 	}
 
+	if opts.listTables || opts.describeTable != "" {
+		var names []string
+		if opts.listTables {
+			names, err = client.EventTypesContext(ctx)
+		} else {
+			names, err = client.KeysetContext(ctx, opts.describeTable)
+		}
+		if err != nil {
+			abort(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	statement := opts.statement()
+	if opts.describe {
+		kind, count, err := client.DescribeRawContext(ctx, statement)
+		if err != nil {
+			abort(queryError(ctx, opts, statement, err))
+		}
+		fmt.Printf("kind: %s\nrows: %d\n", kind, count)
+		return
+	}
+
+	if opts.bucket > 0 {
+		q := opts.query
+		if opts.raw != "" {
+			if q, err = nrql.ParseQuery(opts.raw); err != nil {
+				abortf("Can't split '%s' into buckets: %v\n", opts.raw, err)
+			}
+		}
+		buckets, err := q.Buckets(opts.bucket)
+		if err != nil {
+			abort(err)
+		}
+		for _, bucket := range buckets {
+			bucketOpts := opts
+			bucketOpts.raw = ""
+			bucketOpts.query = bucket
+			bucketOpts.output = bucketPath(
+				opts.output,
+				bucket.SinceTime,
+				opts.bucket,
+			)
+			if err := extract(ctx, *client, bucketOpts); err != nil {
+				abort(err)
+			}
+		}
+		return
+	}
+	if err := extract(ctx, *client, opts); err != nil {
+		abort(err)
+	}
+}
+
+// `readQueries()` reads a --queries-file. Lines starting with "{" are queries
+// saved as JSON, and the rest raw NRQL.
+func readQueries(path string) ([]batchQuery, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var queries []batchQuery
+	for i, line := range strings.Split(string(data), "\n") {
+		line = trim(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "{") {
+			queries = append(queries, batchQuery{line: i + 1, raw: line})
+			continue
+		}
+		q, err := nrql.ParseQueryJSON([]byte(line))
+		if err == nil {
+			err = q.Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		queries = append(queries, batchQuery{line: i + 1, query: q})
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("No queries")
+	}
+	return queries, nil
+}
+
+// `runBatch()` runs each of `opts.batch` into its own file in
+// `opts.outputDir`, at most `opts.concurrency` at a time, and then reports how
+// each went. It exits with an error if any failed.
+func runBatch(client nrql.Client, opts options) {
+	if err := os.MkdirAll(opts.outputDir, 0755); err != nil {
+		abort(err)
+	}
+
+	paths := make([]string, len(opts.batch))
+	errs := make([]error, len(opts.batch))
+	slots := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	for i, query := range opts.batch {
+		queryOpts := opts
+		queryOpts.batch = nil
+		queryOpts.noProgress = true
+		queryOpts.raw = query.raw
+		queryOpts.query = query.query
+		queryOpts.output = filepath.Join(
+			opts.outputDir,
+			strconv.Itoa(i+1)+opts.extension,
+		)
+		paths[i] = queryOpts.output
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			// Each query gets the whole --timeout to itself
+			ctx := context.Background()
+			if opts.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+				defer cancel()
+			}
+			errs[i] = extract(ctx, client, queryOpts)
+		}(i)
+	}
+	wg.Wait()
+
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			fmt.Fprintf(
+				os.Stderr,
+				"FAILED %s (line %d): %v\n",
+				paths[i],
+				opts.batch[i].line,
+				err,
+			)
+		} else {
+			fmt.Fprintf(os.Stderr, "ok     %s\n", paths[i])
+		}
+	}
+	if failed > 0 {
+		abortf("%d of %d queries failed\n", failed, len(errs))
+	}
+}
+
+// `bucketPath()` returns the output path of the bucket starting at `start`:
+// `path` with the start (in UTC) inserted before its extension. Buckets of
+// whole days are named by date alone.
+func bucketPath(path string, start time.Time, step time.Duration) string {
+	layout := "2006-01-02T15-04-05"
+	if step%(24*time.Hour) == 0 {
+		layout = "2006-01-02"
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + start.UTC().Format(layout) +
+		ext
+}
+
+// `extract()` runs the query and writes its results to `opts.output`, or
+// returns why it couldn't.
+func extract(ctx context.Context, client nrql.Client, opts options) error {
 	// Execute the query
-	payload, err := nrql.Client{AccountID: accountID, QueryKey: queryKey}.Exec(q)
+	statement := opts.statement()
+	executedAt := time.Now().UTC()
+	var payload nrql.Payload
+	var err error
+	if opts.all {
+		payload, err = execAll(ctx, client, opts)
+	} else {
+		payload, err = client.ExecRawContext(ctx, statement)
+	}
 	if err != nil {
-		abortf("Error for query '%s': %v", q, err)
+		return queryError(ctx, opts, statement, err)
+	}
+
+	// The total and unknown rows aren't facets, so they aren't counted
+	if facet, ok := payload.(nrql.PayloadFacet); ok && !opts.count {
+		facet.IncludeTotal = opts.includeTotal
+		facet.IncludeUnknown = opts.includeUnknown
+		payload = facet
+	}
+
+	if opts.flatten {
+		if payload, err = nrql.NewFlattenedPayload(
+			payload,
+			opts.flattenDepth,
+		); err != nil {
+			return fmt.Errorf("Error flattening results: %v", err)
+		}
+	}
+
+	if opts.explode != "" {
+		if payload, err = nrql.NewExplodedPayload(
+			payload,
+			opts.explode,
+		); err != nil {
+			return fmt.Errorf("Error exploding results: %v", err)
+		}
+	}
+
+	if opts.pivot != "" {
+		value := opts.pivotValue
+		if value == "" {
+			columns := payload.Columns()
+			for i := len(columns) - 1; i >= 0 && value == ""; i-- {
+				if columns[i] != opts.pivot {
+					value = columns[i]
+				}
+			}
+		}
+		if payload, err = nrql.NewPivotedPayload(
+			payload,
+			opts.pivot,
+			value,
+		); err != nil {
+			return fmt.Errorf("Error pivoting results: %v", err)
+		}
 	}
 
 	// Add the static columns
-	payload = nrql.StaticColumnsPayload{payload, staticColumns}
+	payload = nrql.NewStaticColumnsPayload(payload, opts.staticColumns...)
+
+	if opts.count {
+		rows, err := payload.Rows()
+		if err != nil {
+			return fmt.Errorf("Error counting results: %v", err)
+		}
+		fmt.Println(len(rows))
+		return nil
+	}
 
 	// Format the query
-	if err := nrql.FormatCSV(os.Stdout, payload); err != nil {
-		abort(err)
+	write := writeOutput
+	if opts.append {
+		header, err := readHeader(opts.output, opts.csvOptions.Comma)
+		if err != nil {
+			return fmt.Errorf(
+				"Error reading the header of '%s': %v",
+				opts.output,
+				err,
+			)
+		}
+		opts.csvOptions.ExistingHeader = header
+		write = appendOutput
 	}
+	written := &countingPayload{Payload: payload}
+	if err := write(opts.output, func(w io.Writer) error {
+		return opts.format(w, written, opts)
+	}); err != nil {
+		return err
+	}
+
+	if opts.meta {
+		if err := writeMeta(opts.output, extractMeta{
+			Query:      statement,
+			ExecutedAt: executedAt,
+			AccountID:  client.AccountID,
+			Region:     client.Region,
+			Kind:       payload.Kind().String(),
+			Rows:       written.rows,
+		}); err != nil {
+			return fmt.Errorf(
+				"Error writing the metadata of '%s': %v",
+				opts.output,
+				err,
+			)
+		}
+	}
+	return nil
+}
+
+// countingPayload counts the rows read from the payload it wraps, i.e. (as
+// only --head stops a format early) the rows written, for --meta.
+type countingPayload struct {
+	nrql.Payload
+	rows int
+}
+
+func (p *countingPayload) Rows() ([][]interface{}, error) {
+	rows, err := p.Payload.Rows()
+	p.rows = len(rows)
+	return rows, err
+}
+
+func (p *countingPayload) IterateRows() nrql.RowIterator {
+	p.rows = 0
+	return countingIterator{nrql.IterateRows(p.Payload), &p.rows}
+}
+
+type countingIterator struct {
+	nrql.RowIterator
+	rows *int
+}
+
+func (it countingIterator) Next() bool {
+	if !it.RowIterator.Next() {
+		return false
+	}
+	*it.rows++
+	return true
+}
+
+// The contents of the --meta sidecar file, which make an archived extract
+// self-describing
+type extractMeta struct {
+	Query      string    `json:"query"`
+	ExecutedAt time.Time `json:"executed_at"`
+	AccountID  string    `json:"account_id"`
+	Region     string    `json:"region,omitempty"`
+	Kind       string    `json:"kind"`
+	Rows       int       `json:"rows"` // as written, so at most --head
+}
+
+// `metaPath()` returns the path of the sidecar file for the output file
+// `path`: its extension is replaced with ".meta.json".
+func metaPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".meta.json"
+}
+
+// `writeMeta()` writes `meta` to the sidecar file for `output`. With
+// --append, it describes the latest run rather than the whole file.
+func writeMeta(output string, meta extractMeta) error {
+	return writeOutput(metaPath(output), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(meta)
+	})
 }
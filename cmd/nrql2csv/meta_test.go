@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ns-cweber/nrql2csv/nrqltest"
+)
+
+func TestCountingPayload(t *testing.T) {
+	table := nrqltest.Table{
+		Header: []string{"n"},
+		Data:   [][]interface{}{{1}, {2}, {3}, {4}, {5}},
+	}
+	for _, c := range []struct {
+		format string
+		head   int
+		want   int
+	}{
+		{"csv", 0, 5},
+		{"csv", 2, 2},
+		{"csv", 9, 5},
+		{"tsv", 3, 3},
+		{"table", 4, 4},
+		{"json", 2, 5}, // --head doesn't apply
+		{"ndjson", 0, 5},
+	} {
+		var opts options
+		opts.csvOptions.MaxRows = c.head
+		p := &countingPayload{Payload: table}
+		if err := formatters[c.format](io.Discard, p, opts); err != nil {
+			t.Fatalf("%s: %v", c.format, err)
+		}
+		if p.rows != c.want {
+			t.Errorf(
+				"%s with --head %d: wanted %d rows; got %d",
+				c.format,
+				c.head,
+				c.want,
+				p.rows,
+			)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+)
+
+// `requireToken()` wraps `next` such that requests are only passed through if
+// they carry an `Authorization: Bearer <token>` header; the rest are rejected
+// with HTTP 401 (and logged to `logger`).
+func requireToken(
+	token string,
+	logger nrql.Logger,
+	next http.Handler,
+) http.Handler {
+	if logger == nil {
+		logger = nrql.NopLogger
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nrqld"`)
+			st := http.StatusUnauthorized
+			http.Error(w, http.StatusText(st), st)
+			logger.Printf(
+				"%d missing or invalid bearer token from %s",
+				st,
+				r.RemoteAddr,
+			)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+
+	// Compare in constant time so the token can't be guessed byte-by-byte
+	// from response timings
+	return subtle.ConstantTimeCompare(
+		[]byte(header[len(prefix):]),
+		[]byte(token),
+	) == 1
+}
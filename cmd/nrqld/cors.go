@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+)
+
+// `allowCORS()` wraps `next` such that browsers on `origin` (or any origin if
+// `origin` is "*") may call it. Preflight (OPTIONS) requests are answered
+// directly and never reach `next`, so this must wrap any authentication
+// middleware: browsers don't send credentials with preflights.
+func allowCORS(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if origin == "*" {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// The response depends on the Origin header, so caches must key
+			// on it
+			h.Add("Vary", "Origin")
+			if r.Header.Get("Origin") == origin {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	var reached bool
+	h := allowCORS("https://dash.example.com", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { reached = true },
+	))
+
+	r := httptest.NewRequest("OPTIONS", "/", nil)
+	r.Header.Set("Origin", "https://dash.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Wanted HTTP 204; got %d", w.Code)
+	}
+	if reached {
+		t.Error("The preflight reached the wrapped handler")
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://dash.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, POST, OPTIONS",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s: wanted '%s'; got '%s'", header, want, got)
+		}
+	}
+}
+
+func TestCORSGet(t *testing.T) {
+	d := NRQLDaemon{Querier: newTestClient()}
+	for _, tc := range []struct {
+		allowed, origin, want string
+	}{
+		{"https://dash.example.com", "https://dash.example.com",
+			"https://dash.example.com"},
+		{"https://dash.example.com", "https://evil.example.com", ""},
+		{"*", "https://anyone.example.com", "*"},
+	} {
+		r := httptest.NewRequest("GET", "/?nrql="+
+			"SELECT+count%28%2A%29+FROM+Transaction", nil)
+		r.Header.Set("Origin", tc.origin)
+		w := httptest.NewRecorder()
+		allowCORS(tc.allowed, d).ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Wanted HTTP 200; got %d: %s", w.Code, w.Body)
+		}
+		got := w.Header().Get("Access-Control-Allow-Origin")
+		if got != tc.want {
+			t.Errorf(
+				"Allowing '%s', origin '%s': wanted '%s'; got '%s'",
+				tc.allowed,
+				tc.origin,
+				tc.want,
+				got,
+			)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+)
+
+// An output format for query results, selected by the `format` query
+// parameter
+type format struct {
+	contentType string
+
+	// Stops writing, if it can, when the request's context is done (e.g.,
+	// the client has disconnected)
+	write func(context.Context, io.Writer, nrql.Payload) error
+}
+
+// `withoutContext()` adapts a formatter which can't be stopped part way.
+func withoutContext(
+	write func(io.Writer, nrql.Payload) error,
+) func(context.Context, io.Writer, nrql.Payload) error {
+	return func(_ context.Context, w io.Writer, p nrql.Payload) error {
+		return write(w, p)
+	}
+}
+
+// `csvFormat()` returns a formatter for delimited data separated by `comma`.
+// When the response is streamed (see `flushWriter`), each row is passed on as
+// it's written; otherwise, up to `nrql.DefaultCSVBufferSize` of them are held
+// back, and a small result wouldn't be sent until it was complete.
+func csvFormat(
+	comma rune,
+) func(context.Context, io.Writer, nrql.Payload) error {
+	return func(ctx context.Context, w io.Writer, p nrql.Payload) error {
+		_, streamed := w.(*flushWriter)
+		return nrql.FormatCSVWithOptionsContext(ctx, w, p, nrql.CSVOptions{
+			Comma:     comma,
+			FlushRows: streamed,
+		})
+	}
+}
+
+// The supported `format` values; CSV is the default
+var formats = map[string]format{
+	"csv": {
+		"text/csv; charset=utf-8",
+		csvFormat(','),
+	},
+	"json": {
+		"application/json",
+		withoutContext(nrql.FormatJSON),
+	},
+	"jsonnested": {
+		"application/json",
+		withoutContext(nrql.FormatJSONNested),
+	},
+	"jsonschema": {
+		"application/json",
+		withoutContext(nrql.FormatJSONSchema),
+	},
+	"ndjson": {
+		"application/x-ndjson",
+		withoutContext(nrql.FormatNDJSON),
+	},
+	"parquet": {
+		nrql.ParquetContentType,
+		withoutContext(nrql.FormatParquet),
+	},
+	"tsv": {
+		"text/tab-separated-values; charset=utf-8",
+		csvFormat('\t'),
+	},
+	"xlsx": {
+		nrql.XLSXContentType,
+		withoutContext(nrql.FormatXLSX),
+	},
+}
+
+// `flushWriter` flushes the response within `interval` of each write, so
+// that clients start receiving a large result right away rather than whenever
+// the server's buffers happen to fill, and a slow one as it's written. Call
+// `stop()` once the response is written.
+type flushWriter struct {
+	w        io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	// Guards the response, which the timer's flush would otherwise race
+	// with writes to
+	mu      sync.Mutex
+	timer   *time.Timer // the pending flush, if any
+	stopped bool
+}
+
+// `newFlushWriter()` returns a writer which periodically flushes `w`, or `w`
+// itself if `interval` isn't positive or `w` can't be flushed, and a function
+// which stops the flushing; it must be called before the handler returns.
+func newFlushWriter(
+	w http.ResponseWriter,
+	interval time.Duration,
+) (io.Writer, func()) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || interval <= 0 {
+		return w, func() {}
+	}
+	fw := &flushWriter{w: w, flusher: flusher, interval: interval}
+	return fw, fw.stop
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if err == nil && fw.timer == nil && !fw.stopped {
+		fw.timer = time.AfterFunc(fw.interval, fw.flush)
+	}
+	return n, err
+}
+
+// `flush()` flushes everything written since the last flush.
+func (fw *flushWriter) flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.timer = nil
+	if !fw.stopped {
+		fw.flusher.Flush()
+	}
+}
+
+// `stop()` cancels any pending flush; net/http sends the rest of the response
+// when the handler returns.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
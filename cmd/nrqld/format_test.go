@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+	"github.com/ns-cweber/nrql2csv/nrqltest"
+)
+
+// `failingPayload` yields `rows` rows and then fails, as a lazily decoded
+// payload does on a malformed event.
+type failingPayload struct {
+	rows int
+}
+
+func (p failingPayload) Columns() []string {
+	return []string{"value"}
+}
+
+func (p failingPayload) Rows() ([][]interface{}, error) {
+	return nil, errors.New("bad event")
+}
+
+func (p failingPayload) Kind() nrql.PayloadKind {
+	return nrql.PayloadKindBasic
+}
+
+func (p failingPayload) IterateRows() nrql.RowIterator {
+	return &failingIterator{left: p.rows}
+}
+
+type failingIterator struct {
+	left int
+	err  error
+}
+
+func (it *failingIterator) Next() bool {
+	if it.left == 0 {
+		it.err = errors.New("bad event")
+		return false
+	}
+	it.left--
+	return true
+}
+
+func (it *failingIterator) Row() []interface{} {
+	return []interface{}{"0123456789"}
+}
+
+func (it *failingIterator) Err() error {
+	return it.err
+}
+
+func serveFailing(t *testing.T, rows int) *httptest.ResponseRecorder {
+	t.Helper()
+	c := nrqltest.NewFakeClient()
+	c.Respond(testQuery, failingPayload{rows: rows})
+	rec := httptest.NewRecorder()
+	NRQLDaemon{Querier: c}.ServeHTTP(
+		rec,
+		httptest.NewRequest("GET", "/?nrql="+url.QueryEscape(testQuery), nil),
+	)
+	return rec
+}
+
+func TestFormatErrorBeforeBody(t *testing.T) {
+	rec := serveFailing(t, 1)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("wanted HTTP 500; got %d", rec.Code)
+	}
+}
+
+func TestFormatErrorAfterBody(t *testing.T) {
+	// Enough rows to fill the CSV writer's buffer, so that the body has
+	// started by the time the rows fail
+	rows := 2 * nrql.DefaultCSVBufferSize / len("0123456789\n")
+	rec := serveFailing(t, rows)
+	if rec.Code != http.StatusOK {
+		t.Errorf("wanted the HTTP 200 already sent; got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "value\n0123456789\n") {
+		t.Errorf("wanted the partial CSV; got %.40q", body)
+	}
+	if strings.Contains(body, http.StatusText(http.StatusInternalServerError)) {
+		t.Errorf("an error page was appended to the body")
+	}
+}
+
+// `stallingPayload` yields a single row and then waits for `release` to be
+// closed, as a payload does while it's waiting on the next page.
+type stallingPayload struct {
+	release chan struct{}
+}
+
+func (p stallingPayload) Columns() []string {
+	return []string{"value"}
+}
+
+func (p stallingPayload) Rows() ([][]interface{}, error) {
+	<-p.release
+	return [][]interface{}{{"first"}}, nil
+}
+
+func (p stallingPayload) Kind() nrql.PayloadKind {
+	return nrql.PayloadKindBasic
+}
+
+func (p stallingPayload) IterateRows() nrql.RowIterator {
+	return &stallingIterator{release: p.release}
+}
+
+type stallingIterator struct {
+	release chan struct{}
+	rows    int
+}
+
+func (it *stallingIterator) Next() bool {
+	if it.rows == 1 {
+		<-it.release
+		return false
+	}
+	it.rows++
+	return true
+}
+
+func (it *stallingIterator) Row() []interface{} {
+	return []interface{}{"first"}
+}
+
+func (it *stallingIterator) Err() error {
+	return nil
+}
+
+func TestFormatFlushesWithinInterval(t *testing.T) {
+	release := make(chan struct{})
+	c := nrqltest.NewFakeClient()
+	c.Respond(testQuery, stallingPayload{release: release})
+	server := httptest.NewServer(NRQLDaemon{
+		Querier:       c,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer server.Close()
+	defer close(release) // before the server waits for the request to finish
+
+	// The rows written so far should arrive while the payload is still
+	// stalled, rather than once it's done
+	client := http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Get(server.URL + "/?nrql=" + url.QueryEscape(testQuery))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	r := bufio.NewReader(rsp.Body)
+	for _, wanted := range []string{"value\n", "first\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q wasn't flushed while the payload stalled: %v", wanted, err)
+		}
+		if line != wanted {
+			t.Fatalf("wanted %q; got %q", wanted, line)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+)
+
+// A cheap query used to verify that New Relic is reachable and that our
+// credentials are good
+const readinessQuery = "SELECT count(*) FROM Transaction SINCE 1 minute ago LIMIT 1"
+
+func writeStatus(w http.ResponseWriter, st int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(st)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{status})
+}
+
+// `healthz()` is a liveness probe; it never touches New Relic.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// `readiness` is a readiness probe which runs `readinessQuery` upstream. The
+// outcome is cached for `TTL` so that frequent probes don't eat into the
+// account's query quota.
+type readiness struct {
+	Querier nrql.Querier
+	TTL     time.Duration
+	Timeout time.Duration
+	Log     nrql.Logger // failures are logged here
+
+	lock    sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (rd *readiness) check(ctx context.Context) error {
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+
+	if !rd.checked.IsZero() && time.Since(rd.checked) < rd.TTL {
+		return rd.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rd.Timeout)
+	defer cancel()
+	_, rd.err = rd.Querier.ExecRawContext(ctx, readinessQuery)
+	rd.checked = time.Now()
+	return rd.err
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := rd.check(r.Context()); err != nil {
+		if rd.Log != nil {
+			rd.Log.Printf("Readiness check failed: %v", err)
+		}
+		writeStatus(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	writeStatus(w, http.StatusOK, "ok")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// `newLogger()` returns a logger writing to `w` in the given $LOG_FORMAT:
+// "text" (the default, if empty) for people, or "json" for log aggregators.
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	default:
+		return nil, fmt.Errorf(
+			"Invalid $LOG_FORMAT: %s (wanted text or json)",
+			format,
+		)
+	}
+}
+
+// `printfLogger` adapts a `*slog.Logger` to `nrql.Logger`, for the places
+// which only have a message to log.
+type printfLogger struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+func (l printfLogger) Printf(format string, v ...interface{}) {
+	l.logger.Log(context.Background(), l.level, fmt.Sprintf(format, v...))
+}
+
+// `statusRecorder` captures the status code and body size of a response for
+// the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	// Only the first status is sent; later ones (e.g., from an error after
+	// the body has started) are ignored by net/http
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// `Flush()` passes flushes (see `flushWriter`) through to the underlying
+// writer, if it supports them.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// `wroteHeader()` returns true once the status has been sent, i.e. the
+// response can no longer be replaced with an error.
+func (r *statusRecorder) wroteHeader() bool {
+	return r.status != 0
+}
+
+// `statusCode()` returns the status sent, which is 200 if nothing was written.
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += n
+	return n, err
+}
+
+// `logRequest()` emits the access log event for a query request. Failures are
+// logged at a higher level (WARN for the client's, ERROR for ours) so they
+// can be filtered for.
+func (d NRQLDaemon) logRequest(
+	r *http.Request,
+	rec *statusRecorder,
+	query string,
+	duration time.Duration,
+	err error,
+) {
+	if d.Log == nil {
+		return
+	}
+
+	status := rec.statusCode()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("query", query),
+		slog.Int("status", status),
+		slog.Duration("duration", duration),
+		slog.Int("bytes", rec.bytes),
+		slog.String("remote_addr", r.RemoteAddr),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	d.Log.LogAttrs(context.Background(), level, "request", attrs...)
+}
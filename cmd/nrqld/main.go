@@ -1,65 +1,456 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	nrql "github.com/ns-cweber/nrql2csv"
 )
 
 type NRQLDaemon struct {
-	nrql.Client
+	// Runs the queries; an `nrql.Client`, except in tests
+	Querier nrql.Querier
+
+	// Bounds the number of in-flight upstream requests; each request holds
+	// one slot for its duration. Requests which find every slot taken are
+	// rejected with a 429 straight away rather than queued, so there's no
+	// queue for abandoned requests to pile up in; a request whose caller goes
+	// away frees its slot as soon as its upstream request is abandoned. A nil
+	// semaphore means no limit.
+	Semaphore chan struct{}
+
+	// Whether to also log each query as it starts; every request is logged
+	// when it finishes regardless
+	Verbose bool
+
+	// The access log; nothing is logged if nil
+	Log *slog.Logger
+
+	// How long to wait for New Relic (including any retries) before giving
+	// up with a 504; if zero, forever
+	UpstreamTimeout time.Duration
+
+	// How soon to flush what's been written of the response; if zero, it's
+	// sent as buffers fill
+	FlushInterval time.Duration
+
+	// Records the outcome of each query request for /metrics; nothing is
+	// recorded if nil
+	Metrics *metrics
 }
 
-func (d NRQLDaemon) handleRequest(w io.Writer, qstring string) (int, error) {
-	log.Println("Executing query:", qstring)
-	p, err := d.Client.ExecRaw(qstring)
+// Tries to claim an upstream slot without blocking; returns false if they're
+// all taken.
+func (d NRQLDaemon) acquire() bool {
+	if d.Semaphore == nil {
+		return true
+	}
+	select {
+	case d.Semaphore <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d NRQLDaemon) release() {
+	if d.Semaphore != nil {
+		<-d.Semaphore
+	}
+}
+
+func (d NRQLDaemon) handleRequest(
+	ctx context.Context,
+	w http.ResponseWriter,
+	qstring string,
+	f format,
+) (nrql.PayloadKind, int, error) {
+	if d.Verbose && d.Log != nil {
+		d.Log.Info("executing query", "query", qstring)
+	}
+
+	upstreamCtx := ctx
+	if d.UpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		upstreamCtx, cancel = context.WithTimeout(ctx, d.UpstreamTimeout)
+		defer cancel()
+	}
+	p, err := d.Querier.ExecRawContext(upstreamCtx, qstring)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		// Our deadline rather than the caller's
+		if ctx.Err() == nil && upstreamCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf(
+				"New Relic didn't respond within %v: %v",
+				d.UpstreamTimeout,
+				err,
+			)
+			return nrql.PayloadKindUnknown, http.StatusGatewayTimeout, err
+		}
+		if errors.Is(err, nrql.ErrResponseTooLarge) {
+			return nrql.PayloadKindUnknown, http.StatusBadGateway, err
+		}
+		return nrql.PayloadKindUnknown, http.StatusInternalServerError, err
 	}
 
-	if err := nrql.FormatCSV(w, p); err != nil {
-		return http.StatusInternalServerError, err
+	w.Header().Set("Content-Type", f.contentType)
+	out, stop := newFlushWriter(w, d.FlushInterval)
+	err = f.write(ctx, out, p)
+	stop()
+	if err != nil {
+		return p.Kind(), http.StatusInternalServerError, err
 	}
 
-	return http.StatusOK, nil
+	return p.Kind(), http.StatusOK, nil
+}
+
+// The most NRQL we'll read from a POST body; this is far longer than any query
+// New Relic will accept, but it keeps a misbehaving client from making us
+// buffer an arbitrary amount of data.
+const maxQueryBytes = 1 << 20
+
+// `readQuery()` extracts the NRQL from `r`. GET requests carry it in the
+// `nrql` query parameter; POST requests carry it in the body, either as an
+// `nrql` form field or (for `text/plain`) as the entire body. The latter
+// exists because long queries (e.g., huge `WHERE ... IN (...)` lists) exceed
+// URL length limits and get truncated by proxies.
+func readQuery(w http.ResponseWriter, r *http.Request) (string, int, error) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return r.URL.Query().Get("nrql"), http.StatusOK, nil
+	case http.MethodPost:
+	default:
+		return "", http.StatusMethodNotAllowed, fmt.Errorf(
+			"unsupported method: %s",
+			r.Method,
+		)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxQueryBytes)
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf(
+			"invalid Content-Type: %v",
+			err,
+		)
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		return r.PostForm.Get("nrql"), http.StatusOK, nil
+	case "text/plain":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		return strings.TrimSpace(string(data)), http.StatusOK, nil
+	default:
+		return "", http.StatusUnsupportedMediaType, fmt.Errorf(
+			"unsupported Content-Type: %s",
+			mediaType,
+		)
+	}
 }
 
 func (d NRQLDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if st, err := d.handleRequest(w, r.URL.Query().Get("nrql")); err != nil {
+	// Every request gets exactly one access log event (and one observation
+	// in the metrics), whatever the outcome
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	var qstring string
+	var failure error
+	kind := "none" // until there's a payload
+	defer func(start time.Time) {
+		duration := time.Since(start)
+		d.logRequest(r, rec, qstring, duration, failure)
+		if d.Metrics != nil {
+			d.Metrics.observeRequest(rec.statusCode(), kind, duration)
+		}
+	}(time.Now())
+
+	qstring, st, err := readQuery(w, r)
+	if err == nil && qstring == "" {
+		st, err = http.StatusBadRequest, fmt.Errorf("missing query")
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "csv"
+	}
+	f, ok := formats[name]
+	if err == nil && !ok {
+		st, err = http.StatusBadRequest, fmt.Errorf("unknown format: %s", name)
+	}
+	if err != nil {
+		if st == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		}
+		http.Error(w, err.Error(), st)
+		failure = err
+		return
+	}
+
+	if !d.acquire() {
+		w.Header().Set("Retry-After", "1")
+		st := http.StatusTooManyRequests
 		http.Error(w, http.StatusText(st), st)
-		log.Println(st, err)
+		failure = fmt.Errorf("concurrency limit reached")
+		return
+	}
+	defer d.release()
+
+	// Pass the inbound context along so that the upstream request is
+	// abandoned (and its slot freed) if the caller goes away.
+	k, st, err := d.handleRequest(r.Context(), w, qstring, f)
+	if k != nrql.PayloadKindUnknown {
+		kind = k.String()
+	}
+	if err != nil {
+		// Once the body has started, its status has been sent, and an error
+		// page would only be appended to the partial result; the failure is
+		// just logged
+		if !rec.wroteHeader() {
+			http.Error(w, http.StatusText(st), st)
+		}
+		failure = err
 		return
 	}
 }
 
+// `readinessClient()` returns a copy of `client` for the readiness probe. The
+// check is pointless if it's answered from the cache, and its upstream requests
+// aren't the daemon's traffic, so they're left out of the metrics.
+func readinessClient(client nrql.Client) nrql.Client {
+	client = client.Uncached()
+	client.OnResponse = nil
+	return client
+}
+
 func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+}
+
+// `run()` configures and runs the daemon until it's signalled to shut down.
+func run() error {
+	verbose := flag.Bool(
+		"verbose",
+		false,
+		"[OPTIONAL] log each query, the upstream HTTP status, response size "+
+			"and timing",
+	)
+	flag.Parse()
+
+	logger, err := newLogger(os.Stderr, os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		return err
+	}
+	info := printfLogger{logger, slog.LevelInfo}
+	warn := printfLogger{logger, slog.LevelWarn}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	addr := ":" + port
 
-	accountID := os.Getenv("NEW_RELIC_ACCOUNT_ID")
-	if accountID == "" {
-		fmt.Fprintln(os.Stderr, "Missing $NEW_RELIC_ACCOUNT_ID")
-		os.Exit(-1)
+	var semaphore chan struct{}
+	if s := os.Getenv("MAX_CONCURRENCY"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid $MAX_CONCURRENCY: %s", s)
+		}
+		semaphore = make(chan struct{}, n)
 	}
 
-	queryKey := os.Getenv("NEW_RELIC_QUERY_KEY")
-	if queryKey == "" {
-		fmt.Fprintln(os.Stderr, "Missing $NEW_RELIC_QUERY_KEY")
-		os.Exit(-1)
+	// How long to wait for in-flight requests (e.g., CSV streams) to finish
+	// once we're asked to shut down
+	gracePeriod := 30 * time.Second
+	if s := os.Getenv("SHUTDOWN_GRACE_PERIOD"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid $SHUTDOWN_GRACE_PERIOD: %s", s)
+		}
+		gracePeriod = d
+	}
+
+	// How often to flush large responses (e.g., CSV extracts) as they're
+	// written, so that downloads start straight away
+	var flushInterval time.Duration
+	if s := os.Getenv("FLUSH_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid $FLUSH_INTERVAL: %s", s)
+		}
+		flushInterval = d
+	}
+
+	var upstreamTimeout time.Duration
+	if s := os.Getenv("UPSTREAM_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid $UPSTREAM_TIMEOUT: %s", s)
+		}
+		upstreamTimeout = d
+	}
+
+	// Transient upstream failures (HTTP 429 and 5xx, dropped connections)
+	// are retried before they're passed on to our callers as 500s
+	retries := 2
+	if s := os.Getenv("UPSTREAM_RETRIES"); s != "" {
+		if retries, err = strconv.Atoi(s); err != nil || retries < 0 {
+			return fmt.Errorf("Invalid $UPSTREAM_RETRIES: %s", s)
+		}
+	}
+	clientOptions := []nrql.Option{
+		nrql.WithRetry(nrql.RetryPolicy{
+			MaxAttempts: retries + 1,
+			MaxBackoff:  5 * time.Second,
+		}),
+		// So that the formatters which iterate over rows (e.g., CSV) don't
+		// first decode every event of a large result
+		nrql.WithLazyEvents(),
+	}
+
+	// A cap on each upstream response, so that one pathological query can't
+	// exhaust our memory
+	if s := os.Getenv("MAX_RESPONSE_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid $MAX_RESPONSE_SIZE: %s", s)
+		}
+		clientOptions = append(clientOptions, nrql.WithMaxResponseSize(n))
 	}
 
-	log.Println("Listening at", addr)
-	if err := http.ListenAndServe(
-		addr,
-		NRQLDaemon{nrql.Client{AccountID: accountID, QueryKey: queryKey}},
-	); err != nil {
-		log.Fatal(err)
+	if s := os.Getenv("CACHE_TTL"); s != "" {
+		ttl, err := time.ParseDuration(s)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("Invalid $CACHE_TTL: %s", s)
+		}
+		clientOptions = append(clientOptions, nrql.WithCache(nrql.NewCache(ttl)))
+	}
+
+	// Queries per minute across all requests, to stay under the account's
+	// quota; excess queries wait their turn rather than failing
+	if s := os.Getenv("RATE_LIMIT"); s != "" {
+		perMinute, err := strconv.Atoi(s)
+		if err != nil || perMinute < 1 {
+			return fmt.Errorf("Invalid $RATE_LIMIT: %s", s)
+		}
+		burst := 1
+		if s := os.Getenv("RATE_LIMIT_BURST"); s != "" {
+			if burst, err = strconv.Atoi(s); err != nil || burst < 1 {
+				return fmt.Errorf("Invalid $RATE_LIMIT_BURST: %s", s)
+			}
+		}
+		clientOptions = append(
+			clientOptions,
+			nrql.WithRateLimiter(nrql.NewTokenBucket(perMinute, burst)),
+		)
+	}
+
+	// The client logs the upstream side of each query (but never the
+	// credentials)
+	if *verbose {
+		clientOptions = append(clientOptions, nrql.WithLogger(info))
+	}
+
+	client, err := nrql.LoadClient(
+		os.Getenv("NEW_RELIC_PROFILE"),
+		clientOptions...,
+	)
+	if err != nil {
+		return err
+	}
+
+	m := newMetrics()
+	client.OnResponse = m.observeUpstream
+
+	var queryHandler http.Handler = NRQLDaemon{
+		Querier:         *client,
+		Semaphore:       semaphore,
+		Verbose:         *verbose,
+		Log:             logger,
+		FlushInterval:   flushInterval,
+		UpstreamTimeout: upstreamTimeout,
+		Metrics:         m,
+	}
+
+	if token := os.Getenv("NRQLD_AUTH_TOKEN"); token != "" {
+		queryHandler = requireToken(token, warn, queryHandler)
+	} else {
+		logger.Warn(
+			"$NRQLD_AUTH_TOKEN is unset; anyone who can reach the daemon can "+
+				"run arbitrary NRQL against the account",
+			"addr", addr,
+			"account", client.AccountID,
+		)
+	}
+
+	// The probes (and the metrics) are deliberately unauthenticated; load
+	// balancers, kubelets and Prometheus don't carry our token.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.Handle("/metrics", m)
+	mux.Handle("/readyz", &readiness{
+		Querier: readinessClient(*client),
+		TTL:     5 * time.Second,
+		Timeout: 5 * time.Second,
+		Log:     warn,
+	})
+	mux.Handle("/", queryHandler)
+
+	var handler http.Handler = mux
+	if origin := os.Getenv("NRQLD_CORS_ORIGIN"); origin != "" {
+		handler = allowCORS(origin, handler)
+	}
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		logger.Info(
+			"shutting down; waiting for requests",
+			"grace_period", gracePeriod,
+		)
+		shutdownCtx, cancel := context.WithTimeout(
+			context.Background(),
+			gracePeriod,
+		)
+		defer cancel()
+		done <- server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("listening", "addr", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("Shutdown: %v", err)
 	}
+	logger.Info("shut down cleanly")
+	return nil
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+	"github.com/ns-cweber/nrql2csv/nrqltest"
+)
+
+const testQuery = "SELECT count(*) FROM Transaction"
+
+// `blockingQuerier` holds each query (after announcing it on `started`) until
+// `release` is closed, so that tests can keep requests in flight.
+type blockingQuerier struct {
+	*nrqltest.FakeClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (q blockingQuerier) ExecRawContext(
+	ctx context.Context,
+	query string,
+) (nrql.Payload, error) {
+	q.started <- struct{}{}
+	select {
+	case <-q.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return q.FakeClient.ExecRawContext(ctx, query)
+}
+
+func newTestClient() *nrqltest.FakeClient {
+	c := nrqltest.NewFakeClient()
+	c.Respond(testQuery, nrqltest.Table{
+		Header: []string{"count"},
+		Data:   [][]interface{}{{42.0}},
+	})
+	return c
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	const limit = 3
+	querier := blockingQuerier{
+		FakeClient: newTestClient(),
+		started:    make(chan struct{}, limit+1),
+		release:    make(chan struct{}),
+	}
+	d := NRQLDaemon{
+		Querier:   querier,
+		Semaphore: make(chan struct{}, limit),
+	}
+
+	// Every request but one gets a slot and waits upstream; the odd one out
+	// is rejected without waiting
+	responses := make(chan *httptest.ResponseRecorder, limit+1)
+	for i := 0; i < limit+1; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			d.ServeHTTP(w, httptest.NewRequest("GET", "/?nrql="+
+				"SELECT+count%28%2A%29+FROM+Transaction", nil))
+			responses <- w
+		}()
+	}
+
+	rejected := <-responses
+	if rejected.Code != http.StatusTooManyRequests {
+		t.Fatalf("Wanted HTTP 429 first; got %d", rejected.Code)
+	}
+	if rejected.Header().Get("Retry-After") == "" {
+		t.Error("Wanted a Retry-After header on the 429")
+	}
+
+	close(querier.release)
+	for i := 0; i < limit; i++ {
+		if w := <-responses; w.Code != http.StatusOK {
+			t.Errorf("Wanted HTTP 200; got %d: %s", w.Code, w.Body)
+		}
+	}
+	if n := len(querier.started); n != limit {
+		t.Errorf("Wanted %d upstream queries; got %d", limit, n)
+	}
+}
+
+func TestConcurrencyLimitFreesSlots(t *testing.T) {
+	d := NRQLDaemon{
+		Querier:   newTestClient(),
+		Semaphore: make(chan struct{}, 1),
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest("GET", "/?nrql="+
+			"SELECT+count%28%2A%29+FROM+Transaction", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: wanted HTTP 200; got %d", i+1, w.Code)
+		}
+	}
+}
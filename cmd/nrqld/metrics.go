@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of Prometheus's text exposition format to
+// serve a few counters and histograms, rather than pulling in the client
+// library for them. See
+// https://prometheus.io/docs/instrumenting/exposition_formats/ for the
+// specification.
+
+// The upper bounds of the latency histograms' buckets, in seconds (the same as
+// the client library's defaults)
+var latencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// `metrics` collects the daemon's request and upstream metrics, and serves
+// them at /metrics. Make one with `newMetrics()`.
+type metrics struct {
+	mu sync.Mutex
+
+	// Each is keyed by its rendered labels, e.g. `kind="basic"`
+	requests         map[string]float64
+	durations        map[string]*histogram // by payload kind
+	upstream         map[string]float64    // by upstream status
+	upstreamDuration map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:         map[string]float64{},
+		durations:        map[string]*histogram{},
+		upstream:         map[string]float64{},
+		upstreamDuration: map[string]*histogram{"": newHistogram()},
+	}
+}
+
+// `observeRequest()` records a query request's outcome. `kind` is the kind
+// of payload returned, or "none" if the request failed before there was one.
+func (m *metrics) observeRequest(status int, kind string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[labels("kind", kind, "status", strconv.Itoa(status))]++
+	observe(m.durations, labels("kind", kind), d.Seconds())
+}
+
+// `observeUpstream()` records a request to New Relic; it has the signature of
+// `nrql.Client.OnResponse`.
+func (m *metrics) observeUpstream(
+	nrql string,
+	status int,
+	d time.Duration,
+	bytes int,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream[labels("status", strconv.Itoa(status))]++
+	observe(m.upstreamDuration, "", d.Seconds())
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeCounter(
+		w,
+		"nrqld_requests_total",
+		"Query requests handled, by HTTP status and payload kind.",
+		m.requests,
+	)
+	writeHistogram(
+		w,
+		"nrqld_request_duration_seconds",
+		"Query request latency, by payload kind.",
+		m.durations,
+	)
+	writeCounter(
+		w,
+		"nrqld_upstream_responses_total",
+		"Requests to New Relic, by HTTP status (0 if there was no response).",
+		m.upstream,
+	)
+	writeHistogram(
+		w,
+		"nrqld_upstream_duration_seconds",
+		"Latency of requests to New Relic.",
+		m.upstreamDuration,
+	)
+}
+
+// `histogram` counts observations into `latencyBuckets`. Make one with
+// `newHistogram()`.
+type histogram struct {
+	counts []uint64 // of the observations in each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+// `observe()` records `v` in the histogram in `series` with the given
+// `labels`, adding it if need be.
+func observe(series map[string]*histogram, labels string, v float64) {
+	h, ok := series[labels]
+	if !ok {
+		h = newHistogram()
+		series[labels] = h
+	}
+	if i := sort.SearchFloat64s(latencyBuckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// `labels()` renders the given label names and values, e.g.
+// `labels("kind", "basic")` is `kind="basic"`.
+func labels(namesAndValues ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(namesAndValues[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(namesAndValues[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// `writeSample()` writes a single sample of the metric `name`, e.g.
+// `nrqld_requests_total{kind="basic",status="200"} 1`.
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func writeCounter(w io.Writer, name, help string, series map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	// Sorted, so that the series are written in a stable order
+	keys := make([]string, 0, len(series))
+	for labels := range series {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		writeSample(w, name, labels, series[labels])
+	}
+}
+
+func writeHistogram(
+	w io.Writer,
+	name string,
+	help string,
+	series map[string]*histogram,
+) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(series))
+	for labels := range series {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		h := series[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		// Each bucket counts the observations up to its bound, including
+		// those in the buckets below it
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			writeSample(
+				w,
+				name+"_bucket",
+				prefix+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`,
+				float64(cumulative),
+			)
+		}
+		writeSample(w, name+"_bucket", prefix+`le="+Inf"`, float64(h.count))
+		writeSample(w, name+"_sum", labels, h.sum)
+		writeSample(w, name+"_count", labels, float64(h.count))
+	}
+}
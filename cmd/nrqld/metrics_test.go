@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns-cweber/nrql2csv"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	m.observeRequest(http.StatusOK, "aggregation", 20*time.Millisecond)
+	m.observeRequest(http.StatusOK, "aggregation", 2*time.Second)
+	m.observeRequest(http.StatusBadRequest, "none", time.Millisecond)
+	m.observeUpstream(testQuery, 0, time.Second, 0)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(
+		got,
+		"text/plain; version=0.0.4",
+	) {
+		t.Errorf("wanted Prometheus's text format; got %q", got)
+	}
+	for _, want := range []string{
+		`nrqld_requests_total{kind="aggregation",status="200"} 2`,
+		`nrqld_requests_total{kind="none",status="400"} 1`,
+		`nrqld_request_duration_seconds_bucket{kind="aggregation",le="0.025"} 1`,
+		`nrqld_request_duration_seconds_bucket{kind="aggregation",le="2.5"} 2`,
+		`nrqld_request_duration_seconds_bucket{kind="aggregation",le="+Inf"} 2`,
+		`nrqld_request_duration_seconds_sum{kind="aggregation"} 2.02`,
+		`nrqld_request_duration_seconds_count{kind="aggregation"} 2`,
+		"# TYPE nrqld_request_duration_seconds histogram\n",
+		`nrqld_upstream_responses_total{status="0"} 1`,
+		`nrqld_upstream_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q from:\n%s", want, body)
+		}
+	}
+}
+
+func TestReadinessClientSkipsMetrics(t *testing.T) {
+	m := newMetrics()
+	client := nrql.Client{
+		AccountID:  "1",
+		QueryKey:   "key",
+		Cache:      nrql.NewCache(time.Minute),
+		OnResponse: m.observeUpstream,
+	}
+	ready := readinessClient(client)
+	if ready.Cache != nil {
+		t.Errorf("the readiness probe's client has a cache")
+	}
+	if ready.OnResponse != nil {
+		t.Errorf("the readiness probe's client reports to the metrics")
+	}
+	if client.OnResponse == nil {
+		t.Errorf("the query client no longer reports to the metrics")
+	}
+}
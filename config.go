@@ -0,0 +1,162 @@
+package nrql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The name of the config file, relative to the user's home directory
+const ConfigFileName = ".nrql2csv.json"
+
+// A Profile holds the credentials for one New Relic account.
+type Profile struct {
+	AccountID string `json:"account_id"`
+	QueryKey  string `json:"query_key"`
+	Region    string `json:"region"`
+}
+
+// `String()` redacts the query key so that profiles are safe to log.
+func (p Profile) String() string {
+	return fmt.Sprintf(
+		"{AccountID:%s QueryKey:%s Region:%s}",
+		p.AccountID,
+		redact(p.QueryKey),
+		p.Region,
+	)
+}
+
+// `GoString()` redacts the query key from `%#v` output as well.
+func (p Profile) GoString() string {
+	return "nrql.Profile" + p.String()
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// `Client()` returns a client for the profile's account. Unlike
+// `NewClient()`, it doesn't check the credentials.
+func (p Profile) Client() Client {
+	return Client{AccountID: p.AccountID, QueryKey: p.QueryKey, Region: p.Region}
+}
+
+// `NewClient()` is like the package's `NewClient()`, for the profile's
+// account and region. The errors for missing credentials say where they can be
+// set; they still satisfy `errors.Is()` for `ErrMissingAccountID` and
+// `ErrMissingQueryKey`.
+func (p Profile) NewClient(opts ...Option) (*Client, error) {
+	c, err := NewClient(
+		p.AccountID,
+		p.QueryKey,
+		append([]Option{WithRegion(p.Region)}, opts...)...,
+	)
+	switch err {
+	case ErrMissingAccountID:
+		return nil, fmt.Errorf(
+			"%w; set $NEW_RELIC_ACCOUNT_ID or the profile's account_id",
+			err,
+		)
+	case ErrMissingQueryKey:
+		// https://docs.newrelic.com/docs/insights/export-insights-data/export-api/query-insights-event-data-api#register
+		return nil, fmt.Errorf(
+			"%w; set $NEW_RELIC_QUERY_KEY or the profile's query_key",
+			err,
+		)
+	}
+	return c, err
+}
+
+// `LoadClient()` returns a client for the profile `name`, resolved as by
+// `LoadProfile()` and checked as by `Profile.NewClient()`. This is how the
+// command-line tools get their clients, so their credential handling can't
+// drift apart.
+func LoadClient(name string, opts ...Option) (*Client, error) {
+	p, err := LoadProfile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading profile: %v", err)
+	}
+	return p.NewClient(opts...)
+}
+
+// A Config is the contents of the config file: a set of named profiles. For
+// example:
+//
+//	{
+//	    "profiles": {
+//	        "default": {"account_id": "123", "query_key": "..."},
+//	        "europe": {"account_id": "456", "query_key": "...", "region": "EU"}
+//	    }
+//	}
+type Config struct {
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// `DefaultConfigPath()` returns the path of the config file in the user's
+// home directory.
+func DefaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ConfigFileName), nil
+}
+
+// `LoadConfig()` reads the config file at `path`.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("Parsing config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// `LoadProfile()` resolves the credentials for the profile `name` from the
+// default config file, overridden by the `NEW_RELIC_ACCOUNT_ID`,
+// `NEW_RELIC_QUERY_KEY`, and `NEW_RELIC_REGION` environment variables. If
+// `name` is empty, the "default" profile is used if it exists; it's only an
+// error for a named profile (or the config file containing it) to be missing.
+// The returned profile may still lack an account ID or query key; use
+// `Profile.NewClient()` to check.
+func LoadProfile(name string) (Profile, error) {
+	var p Profile
+
+	path, err := DefaultConfigPath()
+	if err != nil {
+		if name != "" {
+			return p, err
+		}
+	} else if c, err := LoadConfig(path); err == nil {
+		var ok bool
+		lookup := name
+		if lookup == "" {
+			lookup = "default"
+		}
+		if p, ok = c.Profiles[lookup]; !ok && name != "" {
+			return p, fmt.Errorf("No profile '%s' in %s", name, path)
+		}
+	} else if name != "" || !os.IsNotExist(err) {
+		return p, err
+	}
+
+	// The environment takes precedence over the file
+	if v := os.Getenv("NEW_RELIC_ACCOUNT_ID"); v != "" {
+		p.AccountID = v
+	}
+	if v := os.Getenv("NEW_RELIC_QUERY_KEY"); v != "" {
+		p.QueryKey = v
+	}
+	if v := os.Getenv("NEW_RELIC_REGION"); v != "" {
+		p.Region = v
+	}
+	return p, nil
+}
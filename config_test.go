@@ -0,0 +1,121 @@
+package nrql
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// `useHome()` points the config file at a fresh home directory and clears
+// the environment's credentials. If `config` isn't empty, that fixture is
+// the config file.
+func useHome(t *testing.T, config string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, name := range []string{
+		"NEW_RELIC_ACCOUNT_ID",
+		"NEW_RELIC_QUERY_KEY",
+		"NEW_RELIC_REGION",
+	} {
+		t.Setenv(name, "")
+	}
+	if config == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join("testdata", config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(home, ConfigFileName)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadClient(t *testing.T) {
+	useHome(t, "config.json")
+	for _, c := range []struct {
+		name   string
+		want   Profile
+		env    map[string]string
+		errMsg string
+		errIs  error
+	}{
+		{name: "", want: Profile{"123", "default-key", ""}},
+		{name: "europe", want: Profile{"456", "eu-key", "EU"}},
+		{
+			name: "europe",
+			env:  map[string]string{"NEW_RELIC_ACCOUNT_ID": "999"},
+			want: Profile{"999", "eu-key", "EU"},
+		},
+		{name: "missing", errMsg: "No profile 'missing'"},
+		{
+			name:   "keyless",
+			errMsg: "$NEW_RELIC_QUERY_KEY",
+			errIs:  ErrMissingQueryKey,
+		},
+	} {
+		for k, v := range c.env {
+			t.Setenv(k, v)
+		}
+		client, err := LoadClient(c.name)
+		for k := range c.env {
+			t.Setenv(k, "")
+		}
+
+		if c.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+				t.Errorf(
+					"%q: wanted an error about %q; got %v",
+					c.name,
+					c.errMsg,
+					err,
+				)
+			}
+			if c.errIs != nil && !errors.Is(err, c.errIs) {
+				t.Errorf("%q: wanted %v; got %v", c.name, c.errIs, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.name, err)
+			continue
+		}
+		got := Profile{client.AccountID, client.QueryKey, client.Region}
+		if got != c.want {
+			t.Errorf("%q: wanted %#v; got %#v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestLoadClientWithoutConfig(t *testing.T) {
+	useHome(t, "")
+	if _, err := LoadClient(""); !errors.Is(err, ErrMissingAccountID) ||
+		!strings.Contains(err.Error(), "$NEW_RELIC_ACCOUNT_ID") {
+		t.Errorf("wanted ErrMissingAccountID, explained; got %v", err)
+	}
+	if _, err := LoadClient("europe"); err == nil {
+		t.Errorf("wanted an error for a named profile without a config file")
+	}
+
+	t.Setenv("NEW_RELIC_ACCOUNT_ID", " 123\n")
+	t.Setenv("NEW_RELIC_QUERY_KEY", "key\n")
+	client, err := LoadClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.AccountID != "123" || client.QueryKey != "key" {
+		t.Errorf("the credentials weren't trimmed: %#v", client)
+	}
+}
+
+func TestLoadClientMalformedConfig(t *testing.T) {
+	useHome(t, "config_malformed.json")
+	if _, err := LoadClient(""); err == nil ||
+		!strings.Contains(err.Error(), "Parsing config file") {
+		t.Errorf("wanted a parse error; got %v", err)
+	}
+}
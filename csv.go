@@ -1,10 +1,15 @@
 package nrql
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
 	"strconv"
+	"strings"
 )
 
 // Take anything and figure out how to make it into a string; normally we would
@@ -25,34 +30,582 @@ func stringify(v interface{}) string {
 	}
 }
 
+// `cell()` returns `row[i]`, or nil if the row is too short to have it.
+// Payloads aren't guaranteed to be rectangular; the API sometimes omits cells.
+func cell(row []interface{}, i int) interface{} {
+	if i < len(row) {
+		return row[i]
+	}
+	return nil
+}
+
+// A BoolFormat selects how booleans are rendered in delimited output.
+type BoolFormat int
+
+const (
+	// "true" and "false" (the default)
+	BoolFormatTrueFalse BoolFormat = iota
+
+	// "1" and "0"
+	BoolFormatOneZero
+
+	// "TRUE" and "FALSE"
+	BoolFormatUpper
+)
+
+// The `BoolFormat`s by name, as accepted by `ParseBoolFormat()`
+var boolFormatNames = map[string]BoolFormat{
+	"truefalse": BoolFormatTrueFalse,
+	"10":        BoolFormatOneZero,
+	"TF":        BoolFormatUpper,
+}
+
+// `ParseBoolFormat()` returns the `BoolFormat` named `s`: "truefalse", "10"
+// or "TF".
+func ParseBoolFormat(s string) (BoolFormat, error) {
+	if f, ok := boolFormatNames[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf(
+		"Unknown boolean format '%s'; wanted one of: truefalse, 10, TF",
+		s,
+	)
+}
+
+func (f BoolFormat) format(b bool) string {
+	switch f {
+	case BoolFormatOneZero:
+		if b {
+			return "1"
+		}
+		return "0"
+	case BoolFormatUpper:
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return strconv.FormatBool(b)
+	}
+}
+
+// A FloatFormat selects the notation of floats in delimited output.
+type FloatFormat int
+
+const (
+	// Fixed-point, e.g. "100000000000000000000" (the default)
+	FloatFormatFixed FloatFormat = iota
+
+	// Scientific, e.g. "1e+20"
+	FloatFormatScientific
+
+	// Scientific for large exponents and fixed-point otherwise, like Go's
+	// %g
+	FloatFormatAuto
+)
+
+// The `FloatFormat`s by name, as accepted by `ParseFloatFormat()`
+var floatFormatNames = map[string]FloatFormat{
+	"fixed":      FloatFormatFixed,
+	"scientific": FloatFormatScientific,
+	"auto":       FloatFormatAuto,
+}
+
+// `ParseFloatFormat()` returns the `FloatFormat` named `s`: "fixed",
+// "scientific" or "auto".
+func ParseFloatFormat(s string) (FloatFormat, error) {
+	if f, ok := floatFormatNames[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf(
+		"Unknown float format '%s'; wanted one of: fixed, scientific, auto",
+		s,
+	)
+}
+
+// `format()` renders `x` (a float of `bitSize` bits) with `precision` digits,
+// as for `CSVOptions.FloatPrecision`.
+func (f FloatFormat) format(x float64, precision, bitSize int) string {
+	if precision <= 0 {
+		precision = -1
+	}
+	verb := byte('f')
+	switch f {
+	case FloatFormatScientific:
+		verb = 'e'
+	case FloatFormatAuto:
+		verb = 'g'
+	}
+	return strconv.FormatFloat(x, verb, precision, bitSize)
+}
+
+// An ArrayFormat selects how arrays (e.g., list-valued event attributes) are
+// rendered in delimited output.
+type ArrayFormat int
+
+const (
+	// As JSON, e.g. `["a","b"]` (the default), so they can be parsed back
+	// out unambiguously
+	ArrayFormatJSON ArrayFormat = iota
+
+	// The elements, separated by `CSVOptions.ArraySeparator`, e.g. "a;b", for
+	// tools which split multi-value fields themselves
+	ArrayFormatJoined
+)
+
+// The default `CSVOptions.ArraySeparator`
+const DefaultArraySeparator = ";"
+
+// The default `CSVOptions.BufferSize`, big enough that large extracts to files
+// and sockets take few writes
+const DefaultCSVBufferSize = 64 * 1024
+
+// The default `CSVOptions.RowNumberHeader` and `TableOptions.RowNumberHeader`
+const DefaultRowNumberHeader = "row"
+
+// The UTF-8 encoding of U+FEFF, written first with `CSVOptions.UTF8BOM`
+const UTF8ByteOrderMark = "\xef\xbb\xbf"
+
+// The `ArrayFormat`s by name, as accepted by `ParseArrayFormat()`
+var arrayFormatNames = map[string]ArrayFormat{
+	"json":   ArrayFormatJSON,
+	"joined": ArrayFormatJoined,
+}
+
+// `ParseArrayFormat()` returns the `ArrayFormat` named `s`: "json" or
+// "joined".
+func ParseArrayFormat(s string) (ArrayFormat, error) {
+	if f, ok := arrayFormatNames[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf(
+		"Unknown array format '%s'; wanted one of: json, joined",
+		s,
+	)
+}
+
+// CSVOptions controls the formatting of delimited output. The zero value
+// yields the same output as `FormatCSV()`.
+type CSVOptions struct {
+	// The field delimiter; ',' if zero
+	Comma rune
+
+	// Overrides the formatting of the named columns. Columns which aren't in
+	// the map are formatted by `stringify()`.
+	ColumnFormats map[string]ColumnFormat
+
+	// How booleans are rendered (in columns without a `ColumnFormats`
+	// entry), for loaders with strict boolean parsers
+	BoolFormat BoolFormat
+
+	// The notation of floats (in columns without a `ColumnFormats` entry),
+	// for columns which span many orders of magnitude
+	FloatFormat FloatFormat
+
+	// The number of digits after the decimal point (or, for
+	// `FloatFormatAuto`, significant digits) of floats; if zero, the fewest
+	// which represent each value exactly. Use `IntegerFormat` to round to
+	// integers.
+	FloatPrecision int
+
+	// Whether to render objects (e.g., nested attributes) as JSON, so they
+	// can be parsed back out, rather than in Go's `map[...]` form. Arrays are
+	// rendered according to `ArrayFormat` either way.
+	JSONComplexCells bool
+
+	// How arrays are rendered (in columns without a `ColumnFormats` entry)
+	ArrayFormat ArrayFormat
+
+	// The separator of `ArrayFormatJoined`'s elements;
+	// `DefaultArraySeparator` if empty
+	ArraySeparator string
+
+	// If set, only these columns are written, in this order, e.g. to give
+	// the output of a `SELECT *` query a fixed layout. It's an error for one
+	// not to be among the payload's columns.
+	Columns []string
+
+	// Renames the named columns in the header row (e.g., "count" to
+	// "Total"); other names pass through. `Columns` and `ColumnFormats` still
+	// refer to the original names.
+	Rename map[string]string
+
+	// If non-nil, the output is to be appended to delimited data with this
+	// header row (e.g., yesterday's extract): the header row isn't written
+	// again, and it's an error for the payload's (after `Columns` and
+	// `Rename`) to differ, rather than misaligning the columns.
+	ExistingHeader []string
+
+	// If positive, only the first this many rows are written, e.g. for a
+	// preview which doesn't alter the query (and so its aggregations); the
+	// rest aren't iterated over, so those of a `*LazyPayloadBasic` are never
+	// decoded
+	MaxRows int
+
+	// Whether to prepend a column numbering the rows from 1, e.g. to restore
+	// their order after joining extracts. It's counted in `ExistingHeader`
+	// but not in `Columns`, and it starts from 1 even when appending.
+	AddRowNumber bool
+
+	// The header of the `AddRowNumber` column; `DefaultRowNumberHeader` if
+	// empty
+	RowNumberHeader string
+
+	// Whether to quote every field, headers included, rather than only those
+	// which need it, for strict consumers (e.g., some SQL COPY
+	// configurations)
+	QuoteAll bool
+
+	// Whether to end lines with CRLF rather than LF, for Windows tools and
+	// strict RFC 4180 parsers
+	UseCRLF bool
+
+	// Whether to start with a UTF-8 byte order mark, by which Excel
+	// recognises the encoding rather than assuming the system's code page.
+	// It's not written when appending (see `ExistingHeader`).
+	UTF8BOM bool
+
+	// The size in bytes of the buffer between the writer and `w`;
+	// `DefaultCSVBufferSize` if zero or negative
+	BufferSize int
+
+	// Whether to pass each row on to `w` as soon as it's written, rather
+	// than once the buffer fills, e.g. for a response streamed to a client
+	// as the rows are read (`w` still decides when to send them onward)
+	FlushRows bool
+
+	// If set, warnings (e.g., about dropped cells) are logged here
+	Logger Logger
+}
+
+// A rowWriter writes delimited records; `csv.Writer` is one.
+type rowWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// `quoteAllWriter` is a `rowWriter` which quotes every field, which
+// `csv.Writer` can't be made to do.
+type quoteAllWriter struct {
+	w       *bufio.Writer
+	comma   rune
+	useCRLF bool
+	err     error
+}
+
+func (w *quoteAllWriter) Write(record []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	for i, field := range record {
+		if i > 0 {
+			w.w.WriteRune(w.comma)
+		}
+		w.w.WriteByte('"')
+		w.w.WriteString(strings.Replace(field, `"`, `""`, -1))
+		_, w.err = w.w.WriteString(`"`)
+	}
+	if w.err == nil && w.useCRLF {
+		w.err = w.w.WriteByte('\r')
+	}
+	if w.err == nil {
+		w.err = w.w.WriteByte('\n')
+	}
+	return w.err
+}
+
+func (w *quoteAllWriter) Flush() {
+	if err := w.w.Flush(); w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *quoteAllWriter) Error() error {
+	return w.err
+}
+
+// `newRowWriter()` returns the `rowWriter` for `opts`. It writes to `w`
+// directly, so both it and `w` must be flushed.
+func newRowWriter(w *bufio.Writer, opts CSVOptions) rowWriter {
+	comma := opts.Comma
+	if comma == 0 {
+		comma = ','
+	}
+	if opts.QuoteAll {
+		return &quoteAllWriter{
+			w:       w,
+			comma:   comma,
+			useCRLF: opts.UseCRLF,
+		}
+	}
+	wr := csv.NewWriter(w)
+	wr.Comma = comma
+	wr.UseCRLF = opts.UseCRLF
+	return wr
+}
+
+// `defaultFormat()` returns the format for columns without a `ColumnFormats`
+// entry.
+func (opts CSVOptions) defaultFormat() ColumnFormat {
+	var format ColumnFormat
+	format = func(v interface{}) string {
+		switch x := v.(type) {
+		case bool:
+			return opts.BoolFormat.format(x)
+		case float32:
+			return opts.FloatFormat.format(float64(x), opts.FloatPrecision, 32)
+		case float64:
+			return opts.FloatFormat.format(x, opts.FloatPrecision, 64)
+		case []interface{}:
+			if opts.ArrayFormat == ArrayFormatJoined {
+				return opts.joinArray(x, format)
+			}
+			if s, err := jsonCell(x); err == nil {
+				return s
+			}
+		}
+		if opts.JSONComplexCells && isComplex(v) {
+			if s, err := jsonCell(v); err == nil {
+				return s
+			}
+		}
+		return stringify(v)
+	}
+	return format
+}
+
+// `joinArray()` renders the elements of `array` with `format`, separated by
+// `opts.ArraySeparator`. Nested objects and arrays are rendered as JSON, since
+// joining them too would be ambiguous.
+func (opts CSVOptions) joinArray(
+	array []interface{},
+	format ColumnFormat,
+) string {
+	sep := opts.ArraySeparator
+	if sep == "" {
+		sep = DefaultArraySeparator
+	}
+	elements := make([]string, len(array))
+	for i, element := range array {
+		if isComplex(element) {
+			if s, err := jsonCell(element); err == nil {
+				elements[i] = s
+				continue
+			}
+		}
+		elements[i] = format(element)
+	}
+	return strings.Join(elements, sep)
+}
+
+// `isComplex()` returns true if `v` is an object or array rather than a
+// scalar.
+func isComplex(v interface{}) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	default:
+		return false
+	}
+}
+
+// `jsonCell()` renders `v` as compact JSON. Unlike `json.Marshal()`, it
+// leaves "<", ">" and "&" alone; they're harmless in a CSV.
+func jsonCell(v interface{}) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
 // `FormatCSV()` writes `payload` to `w` in CSV form.
 func FormatCSV(w io.Writer, payload Payload) error {
-	// Make a new CSV writer
-	wr := csv.NewWriter(w)
+	return FormatCSVWithOptions(w, payload, CSVOptions{})
+}
+
+// `FormatCSVContext()` is like `FormatCSV()`, but it stops writing (with
+// `ctx`'s error) when `ctx` is done, e.g. when the client downloading a large
+// result disconnects.
+func FormatCSVContext(ctx context.Context, w io.Writer, payload Payload) error {
+	return FormatCSVWithOptionsContext(ctx, w, payload, CSVOptions{})
+}
+
+// `FormatTSV()` writes `payload` to `w` in tab-separated form.
+func FormatTSV(w io.Writer, payload Payload) error {
+	return FormatCSVWithOptions(w, payload, CSVOptions{Comma: '\t'})
+}
+
+// `FormatTSVContext()` is like `FormatTSV()`, but it stops writing when `ctx`
+// is done, as `FormatCSVContext()` does.
+func FormatTSVContext(ctx context.Context, w io.Writer, payload Payload) error {
+	return FormatCSVWithOptionsContext(
+		ctx,
+		w,
+		payload,
+		CSVOptions{Comma: '\t'},
+	)
+}
+
+// `FormatCSVWithOptions()` writes `payload` to `w` in CSV form, formatted
+// according to `opts`.
+func FormatCSVWithOptions(w io.Writer, payload Payload, opts CSVOptions) error {
+	return FormatCSVWithOptionsContext(context.Background(), w, payload, opts)
+}
+
+// `FormatCSVWithOptionsContext()` is like `FormatCSVWithOptions()`, but it
+// stops writing when `ctx` is done, as `FormatCSVContext()` does. It checks
+// between rows; a row which has been started is finished. The rows are read
+// from `IterateRows()`, so those of a `*LazyPayloadBasic` are decoded only as
+// they're written, and not at all once `ctx` is done.
+func FormatCSVWithOptionsContext(
+	ctx context.Context,
+	w io.Writer,
+	payload Payload,
+	opts CSVOptions,
+) error {
+	// Make a new CSV writer, buffered so that it makes few writes to `w` (unless
+	// `opts.FlushRows`)
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultCSVBufferSize
+	}
+	bw := bufio.NewWriterSize(w, size)
+	wr := newRowWriter(bw, opts)
+	flush := func() error {
+		wr.Flush()
+		if err := wr.Error(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
 
 	headers := payload.Columns()
-	rows := payload.Rows()
+	var indices []int // of the selected columns, if any
+	if len(opts.Columns) > 0 {
+		var err error
+		if indices, err = columnIndices(headers, opts.Columns); err != nil {
+			return err
+		}
+		headers = opts.Columns
+	}
 
-	// Write the headers to the CSV writer
-	if err := wr.Write(headers); err != nil {
-		return err
+	// Write the headers to the CSV writer, unless they're already there
+	header := renameColumns(headers, opts.Rename)
+	if opts.AddRowNumber {
+		header = append(
+			[]string{rowNumberHeader(opts.RowNumberHeader)},
+			header...,
+		)
+	}
+	if opts.ExistingHeader != nil {
+		if !equalStrings(header, opts.ExistingHeader) {
+			return fmt.Errorf(
+				"The columns (%s) don't match the existing header (%s)",
+				strings.Join(header, ", "),
+				strings.Join(opts.ExistingHeader, ", "),
+			)
+		}
+	} else {
+		if opts.UTF8BOM {
+			// Any error resurfaces when the buffer is flushed
+			bw.WriteString(UTF8ByteOrderMark)
+		}
+		if err := wr.Write(header); err != nil {
+			return err
+		}
+		if opts.FlushRows {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Look up each column's formatter once rather than once per cell
+	defaultFormat := opts.defaultFormat()
+	formats := make([]ColumnFormat, len(headers))
+	for i, header := range headers {
+		if formats[i] = opts.ColumnFormats[header]; formats[i] == nil {
+			formats[i] = defaultFormat
+		}
 	}
 
-	// Allocate a row buffer
-	buffer := make([]string, len(headers))
+	// Allocate a row buffer, leaving room for the row number
+	buffer := make([]string, len(header))
+	cells := buffer
+	if opts.AddRowNumber {
+		cells = buffer[1:]
+	}
 
 	// For each row, copy the values into the buffer in the order specified by
-	// the headers. Write the row to the CSV writer.
-	for _, row := range rows {
+	// the headers. Write the row to the CSV writer. Missing cells are empty;
+	// extra cells have no header to go under, so they're dropped.
+	var ragged int
+	rows := IterateRows(payload)
+	for n := 0; opts.MaxRows <= 0 || n < opts.MaxRows; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !rows.Next() {
+			break
+		}
+		row := rows.Row()
+		if indices != nil {
+			row = selectCells(row, indices)
+		} else if len(row) > len(headers) {
+			ragged++
+		}
+		if opts.AddRowNumber {
+			buffer[0] = strconv.Itoa(n + 1)
+		}
 		for i := range headers {
-			buffer[i] = stringify(row[i])
+			cells[i] = formats[i](cell(row, i))
 		}
 		if err := wr.Write(buffer); err != nil {
 			return err
 		}
+		if opts.FlushRows {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	if ragged > 0 {
+		loggerOr(opts.Logger).Printf(
+			"nrql: dropped the extra cells of %d row(s) wider than the %d "+
+				"columns",
+			ragged,
+			len(headers),
+		)
+	}
+
+	// Flush the CSV writer, then the buffer, and return any errors
+	return flush()
+}
 
-	// Flush the CSV writer and return any errors
-	wr.Flush()
-	return wr.Error()
+// `rowNumberHeader()` returns the header of the row number column, given the
+// configured one.
+func rowNumberHeader(header string) string {
+	if header == "" {
+		return DefaultRowNumberHeader
+	}
+	return header
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,247 @@
+package nrql
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// `formatCSV()` returns `p` formatted with `opts`, failing the test on error.
+func formatCSV(t *testing.T, p Payload, opts CSVOptions) string {
+	t.Helper()
+	var b strings.Builder
+	if err := FormatCSVWithOptions(&b, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestFormatCSVRaggedRows(t *testing.T) {
+	var logged strings.Builder
+	got := formatCSV(
+		t,
+		testTable{
+			columns: []string{"a", "b", "c"},
+			rows: [][]interface{}{
+				{"1", "2", "3"},
+				{"4"},
+				{},
+				{"5", "6", "7", "8"},
+			},
+		},
+		CSVOptions{Logger: log.New(&logged, "", 0)},
+	)
+	want := "a,b,c\n1,2,3\n4,,\n,,\n5,6,7\n"
+	if got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+	if !strings.Contains(logged.String(), "1 row(s)") {
+		t.Errorf("wanted a warning about the dropped cell; got %q", logged.String())
+	}
+}
+
+func TestFormatCSVBoolFormats(t *testing.T) {
+	p := testTable{
+		columns: []string{"ok", "name"},
+		rows:    [][]interface{}{{true, "a"}, {false, "b"}, {nil, "c"}},
+	}
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"truefalse", "ok,name\ntrue,a\nfalse,b\n,c\n"},
+		{"10", "ok,name\n1,a\n0,b\n,c\n"},
+		{"TF", "ok,name\nTRUE,a\nFALSE,b\n,c\n"},
+	} {
+		format, err := ParseBoolFormat(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := formatCSV(t, p, CSVOptions{BoolFormat: format})
+		if got != c.want {
+			t.Errorf("%s: wanted %q; got %q", c.name, c.want, got)
+		}
+	}
+
+	// The default is "true"/"false"
+	want := "ok,name\ntrue,a\nfalse,b\n,c\n"
+	if got := formatCSV(t, p, CSVOptions{}); got != want {
+		t.Errorf("default: wanted %q; got %q", want, got)
+	}
+	if _, err := ParseBoolFormat("yesno"); err == nil {
+		t.Errorf("wanted an error for an unknown format")
+	}
+}
+
+func TestFormatCSVQuoteAll(t *testing.T) {
+	p := testTable{
+		columns: []string{"name", "count"},
+		rows:    [][]interface{}{{`say "hi"`, 1.0}, {"a,b", nil}},
+	}
+	got := formatCSV(t, p, CSVOptions{QuoteAll: true})
+	want := `"name","count"` + "\n" +
+		`"say ""hi""","1"` + "\n" +
+		`"a,b",""` + "\n"
+	if got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+
+	got = formatCSV(t, p, CSVOptions{QuoteAll: true, Comma: '\t'})
+	want = "\"name\"\t\"count\"\n" +
+		"\"say \"\"hi\"\"\"\t\"1\"\n" +
+		"\"a,b\"\t\"\"\n"
+	if got != want {
+		t.Errorf("TSV: wanted %q; got %q", want, got)
+	}
+}
+
+func TestFormatCSVUseCRLF(t *testing.T) {
+	p := testTable{
+		columns: []string{"a", "b"},
+		rows:    [][]interface{}{{"1", "2"}},
+	}
+	want := "a,b\r\n1,2\r\n"
+	for _, quoteAll := range []bool{false, true} {
+		got := formatCSV(t, p, CSVOptions{UseCRLF: true, QuoteAll: quoteAll})
+		if quoteAll {
+			want = "\"a\",\"b\"\r\n\"1\",\"2\"\r\n"
+		}
+		if got != want {
+			t.Errorf("QuoteAll %v: wanted %q; got %q", quoteAll, want, got)
+		}
+	}
+}
+
+func TestFormatCSVUTF8BOM(t *testing.T) {
+	p := testTable{
+		columns: []string{"host"},
+		rows:    [][]interface{}{{"café"}},
+	}
+	got := formatCSV(t, p, CSVOptions{UTF8BOM: true})
+	if want := UTF8ByteOrderMark + "host\ncafé\n"; got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+
+	// The file being appended to already starts with one, if it should
+	got = formatCSV(t, p, CSVOptions{
+		UTF8BOM:        true,
+		ExistingHeader: []string{"host"},
+	})
+	if want := "café\n"; got != want {
+		t.Errorf("appending: wanted %q; got %q", want, got)
+	}
+}
+
+// `countingPayload` yields `rows` numbered rows one at a time, counting how
+// many have been asked for.
+type countingPayload struct {
+	rows    int
+	fetched *int
+}
+
+func (p countingPayload) Columns() []string { return []string{"n"} }
+
+func (p countingPayload) Rows() ([][]interface{}, error) {
+	panic("the rows should be iterated")
+}
+
+func (p countingPayload) Kind() PayloadKind { return PayloadKindBasic }
+
+func (p countingPayload) IterateRows() RowIterator {
+	it := &sliceIterator{i: -1}
+	for i := 0; i < p.rows; i++ {
+		it.rows = append(it.rows, []interface{}{float64(i)})
+	}
+	return countingIterator{it, p.fetched}
+}
+
+type countingIterator struct {
+	*sliceIterator
+	fetched *int
+}
+
+func (it countingIterator) Next() bool {
+	*it.fetched++
+	return it.sliceIterator.Next()
+}
+
+func TestFormatCSVContextIterates(t *testing.T) {
+	var fetched int
+	p := countingPayload{rows: 3, fetched: &fetched}
+	if got := formatCSV(t, p, CSVOptions{}); got != "n\n0\n1\n2\n" {
+		t.Errorf("got %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fetched = 0
+	var b strings.Builder
+	err := FormatCSVWithOptionsContext(ctx, &b, p, CSVOptions{})
+	if err != context.Canceled {
+		t.Errorf("wanted %v; got %v", context.Canceled, err)
+	}
+	if fetched != 0 {
+		t.Errorf("%d rows were decoded after the context was done", fetched)
+	}
+}
+
+func TestFormatCSVMaxRows(t *testing.T) {
+	for _, c := range []struct {
+		max, rows int
+		want      string
+	}{
+		{2, 5, "n\n0\n1\n"},
+		{5, 5, "n\n0\n1\n2\n3\n4\n"},
+		{9, 3, "n\n0\n1\n2\n"},
+		{0, 3, "n\n0\n1\n2\n"},
+		{-1, 3, "n\n0\n1\n2\n"},
+	} {
+		var fetched int
+		p := countingPayload{rows: c.rows, fetched: &fetched}
+		got := formatCSV(t, p, CSVOptions{MaxRows: c.max})
+		if got != c.want {
+			t.Errorf("MaxRows %d: wanted %q; got %q", c.max, c.want, got)
+		}
+		if c.max > 0 && c.max < c.rows && fetched != c.max {
+			t.Errorf(
+				"MaxRows %d: iterated over %d rows; wanted only %d",
+				c.max,
+				fetched,
+				c.max,
+			)
+		}
+	}
+}
+
+// `writeRecorder` records each write made to it.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestFormatCSVFlushRows(t *testing.T) {
+	var fetched int
+	p := countingPayload{rows: 3, fetched: &fetched}
+	for _, c := range []struct {
+		flush bool
+		want  []string
+	}{
+		{true, []string{"n\n", "0\n", "1\n", "2\n"}},
+		{false, []string{"n\n0\n1\n2\n"}},
+	} {
+		var w writeRecorder
+		err := FormatCSVWithOptions(&w, p, CSVOptions{FlushRows: c.flush})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(w.writes, c.want) {
+			t.Errorf("FlushRows %v: wanted %q; got %q", c.flush, c.want, w.writes)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package nrql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// `EventTypes()` returns the names of the account's event types (the tables
+// which can be queried), as listed by `SHOW EVENT TYPES` over New Relic's
+// default time range, sorted.
+func (c Client) EventTypes() ([]string, error) {
+	return c.EventTypesContext(context.Background())
+}
+
+// `EventTypesContext()` is like `EventTypes()`, but the request is aborted
+// when `ctx` is done.
+func (c Client) EventTypesContext(ctx context.Context) ([]string, error) {
+	return c.listStrings(ctx, "SHOW EVENT TYPES", func(key string) bool {
+		return key == "eventTypes"
+	})
+}
+
+// `Keyset()` returns the names of the attributes of the event type `table`,
+// as listed by `SELECT keyset()` over New Relic's default time range, sorted.
+func (c Client) Keyset(table string) ([]string, error) {
+	return c.KeysetContext(context.Background(), table)
+}
+
+// `KeysetContext()` is like `Keyset()`, but the request is aborted when `ctx`
+// is done.
+func (c Client) KeysetContext(
+	ctx context.Context,
+	table string,
+) ([]string, error) {
+	// The keys come grouped by type (e.g., "stringKeys"), and all together
+	// as "allKeys"; taking every group and deduplicating covers both
+	return c.listStrings(
+		ctx,
+		"SELECT keyset() FROM "+quoteAttribute(table),
+		func(key string) bool { return strings.HasSuffix(key, "Keys") },
+	)
+}
+
+// `listStrings()` runs `nrql`, whose results are lists of strings under
+// various keys, and returns the distinct strings under the keys for which
+// `want` returns true, sorted.
+func (c Client) listStrings(
+	ctx context.Context,
+	nrql string,
+	want func(key string) bool,
+) ([]string, error) {
+	p, err := c.ExecRawContext(ctx, nrql)
+	if err != nil {
+		return nil, err
+	}
+	aggregation, ok := p.(PayloadAggregation)
+	if !ok {
+		return nil, fmt.Errorf(
+			"Wanted an aggregation payload for '%s'; got %s",
+			nrql,
+			p.Kind(),
+		)
+	}
+
+	seen := map[string]bool{}
+	for _, result := range aggregation.Results {
+		for key, value := range result {
+			list, ok := value.([]interface{})
+			if !ok || !want(key) {
+				continue
+			}
+			for _, element := range list {
+				if s, ok := element.(string); ok {
+					seen[s] = true
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
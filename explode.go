@@ -0,0 +1,69 @@
+package nrql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExplodedPayload is a payload whose list-valued cells in one column (e.g.,
+// the set of values from `uniques(host)`, or a list-valued event attribute)
+// have been exploded into one row per element, with the row's other cells
+// repeated on each. Build one with `NewExplodedPayload()`. Its `Columns()`
+// and `Kind()` are those of the wrapped payload.
+type ExplodedPayload struct {
+	Payload
+	rows [][]interface{}
+}
+
+// `NewExplodedPayload()` explodes the lists in `p`'s `column`. A row whose
+// list is empty is kept, with a null in its place, so that exploding never
+// loses rows; cells which aren't lists are left alone.
+func NewExplodedPayload(p Payload, column string) (ExplodedPayload, error) {
+	columns := p.Columns()
+	c := -1
+	for i, name := range columns {
+		if name == column {
+			c = i
+			break
+		}
+	}
+	if c < 0 {
+		return ExplodedPayload{}, fmt.Errorf(
+			"Unknown column '%s'; wanted one of: %s",
+			column,
+			strings.Join(columns, ", "),
+		)
+	}
+
+	rows, err := p.Rows()
+	if err != nil {
+		return ExplodedPayload{}, err
+	}
+	out := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		list, ok := cell(row, c).([]interface{})
+		if !ok {
+			out = append(out, row)
+			continue
+		}
+		if len(list) == 0 {
+			list = []interface{}{nil}
+		}
+		for _, element := range list {
+			exploded := make([]interface{}, len(columns))
+			copy(exploded, row)
+			exploded[c] = element
+			out = append(out, exploded)
+		}
+	}
+	return ExplodedPayload{Payload: p, rows: out}, nil
+}
+
+// `Rows()` returns new rows each time, so they may be modified freely.
+func (p ExplodedPayload) Rows() ([][]interface{}, error) {
+	out := make([][]interface{}, len(p.rows))
+	for i, row := range p.rows {
+		out[i] = append([]interface{}(nil), row...)
+	}
+	return out, nil
+}
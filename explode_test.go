@@ -0,0 +1,60 @@
+package nrql
+
+import "testing"
+
+func TestUniquesPayload(t *testing.T) {
+	p := loadFixture(t, "uniques.json")
+	checkPayload(
+		t,
+		p,
+		PayloadKindAggregation,
+		[]string{"uniques(host)"},
+		[][]interface{}{{[]interface{}{"web-1", "web-2", "web-3"}}},
+	)
+
+	for _, c := range []struct {
+		format ArrayFormat
+		want   string
+	}{
+		{
+			ArrayFormatJSON,
+			"uniques(host)\n\"[\"\"web-1\"\",\"\"web-2\"\",\"\"web-3\"\"]\"\n",
+		},
+		{ArrayFormatJoined, "uniques(host)\nweb-1;web-2;web-3\n"},
+	} {
+		got := formatCSV(t, p, CSVOptions{ArrayFormat: c.format})
+		if got != c.want {
+			t.Errorf("wanted %q; got %q", c.want, got)
+		}
+	}
+}
+
+func TestExplodedPayload(t *testing.T) {
+	exploded, err := NewExplodedPayload(
+		loadFixture(t, "uniques_facet.json"),
+		"uniques(host)",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty list is kept as a null
+	checkPayload(
+		t,
+		exploded,
+		PayloadKindFacet,
+		[]string{"appName", "uniques(host)"},
+		[][]interface{}{
+			{"checkout", "web-1"},
+			{"checkout", "web-2"},
+			{"search", nil},
+		},
+	)
+}
+
+func TestExplodedPayloadUnknownColumn(t *testing.T) {
+	p := loadFixture(t, "uniques.json")
+	if _, err := NewExplodedPayload(p, "uniques(appName)"); err == nil {
+		t.Error("wanted an error")
+	}
+}
@@ -0,0 +1,106 @@
+package nrql
+
+import "sort"
+
+// The default nesting depth of `NewFlattenedPayload()`
+const DefaultFlattenDepth = 5
+
+// FlattenedPayload is a payload whose nested objects (e.g., custom event
+// attributes holding JSON objects) have been flattened into dotted-path
+// columns, so that a `user` column of `{"id": 1, "name": "x"}` objects becomes
+// `user.id` and `user.name` columns. Build one with `NewFlattenedPayload()`.
+// Its `Kind()` is that of the wrapped payload.
+type FlattenedPayload struct {
+	Payload
+	columns []string
+	rows    [][]interface{}
+}
+
+// `NewFlattenedPayload()` flattens the nested objects in `p`'s rows. The
+// paths of each column are unioned across every row (a row lacking one gets a
+// null there) and sorted, and take the place of the column they came from.
+// Objects nested more than `maxDepth` levels deep are left as they are;
+// `DefaultFlattenDepth` is used if `maxDepth` is zero.
+func NewFlattenedPayload(p Payload, maxDepth int) (FlattenedPayload, error) {
+	if maxDepth == 0 {
+		maxDepth = DefaultFlattenDepth
+	}
+	rows, err := p.Rows()
+	if err != nil {
+		return FlattenedPayload{}, err
+	}
+
+	flat := make([]map[string]interface{}, len(rows))
+	for i := range flat {
+		flat[i] = map[string]interface{}{}
+	}
+	var columns []string
+	seen := map[string]bool{}
+	for c, column := range p.Columns() {
+		paths := map[string]bool{}
+		for r, row := range rows {
+			emit := func(path string, v interface{}) {
+				flat[r][path] = v
+				paths[path] = true
+			}
+			flatten(column, cell(row, c), maxDepth, emit)
+		}
+		// Columns which are null throughout stay put rather than vanishing
+		if len(paths) == 0 {
+			paths[column] = true
+		}
+
+		sorted := make([]string, 0, len(paths))
+		for path := range paths {
+			sorted = append(sorted, path)
+		}
+		sort.Strings(sorted)
+		for _, path := range sorted {
+			if !seen[path] {
+				seen[path] = true
+				columns = append(columns, path)
+			}
+		}
+	}
+
+	out := make([][]interface{}, len(rows))
+	for r := range rows {
+		out[r] = make([]interface{}, len(columns))
+		for i, column := range columns {
+			out[r][i] = flat[r][column]
+		}
+	}
+	return FlattenedPayload{Payload: p, columns: columns, rows: out}, nil
+}
+
+// `flatten()` calls `emit` with the dotted path and value of each non-null
+// leaf of `v`, descending at most `depth` levels into nested objects.
+func flatten(
+	path string,
+	v interface{},
+	depth int,
+	emit func(path string, v interface{}),
+) {
+	if m, ok := v.(map[string]interface{}); ok && depth > 0 {
+		for key, x := range m {
+			flatten(path+"."+key, x, depth-1, emit)
+		}
+		return
+	}
+	if v != nil {
+		emit(path, v)
+	}
+}
+
+func (p FlattenedPayload) Columns() []string {
+	return p.columns
+}
+
+// `Rows()` returns new rows each time, so they may be modified freely.
+func (p FlattenedPayload) Rows() ([][]interface{}, error) {
+	out := make([][]interface{}, len(p.rows))
+	for i, row := range p.rows {
+		out[i] = append([]interface{}(nil), row...)
+	}
+	return out, nil
+}
@@ -0,0 +1,227 @@
+package nrql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A ColumnFormat renders a cell as a string, overriding the default
+// (`stringify()`) formatting for a column.
+type ColumnFormat func(v interface{}) string
+
+// `toFloat()` extracts a float from any numeric cell. JSON numbers always
+// decode to float64, but payloads built in code may use other types.
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	default:
+		return 0, false
+	}
+}
+
+// `isNumericColumn()` returns true if every non-null value in the column is
+// a number (and there's at least one).
+func isNumericColumn(rows [][]interface{}, col int) bool {
+	numeric := false
+	for _, row := range rows {
+		v := cell(row, col)
+		if v == nil {
+			continue
+		}
+		if _, ok := toFloat(v); !ok {
+			return false
+		}
+		numeric = true
+	}
+	return numeric
+}
+
+// `numeric()` adapts a float formatter into a ColumnFormat; non-numeric cells
+// (including nulls) get the default formatting.
+func numeric(f func(float64) string) ColumnFormat {
+	return func(v interface{}) string {
+		if x, ok := toFloat(v); ok {
+			return f(x)
+		}
+		return stringify(v)
+	}
+}
+
+// IntegerFormat renders numbers rounded to the nearest integer.
+var IntegerFormat = numeric(func(x float64) string {
+	return strconv.FormatFloat(math.Round(x), 'f', 0, 64)
+})
+
+// `FixedFormat()` renders numbers with exactly `decimals` decimal places.
+func FixedFormat(decimals int) ColumnFormat {
+	return numeric(func(x float64) string {
+		return strconv.FormatFloat(x, 'f', decimals, 64)
+	})
+}
+
+// `PercentFormat()` renders fractions as percentages (e.g., 0.123 as "12.3%"
+// with one decimal place).
+func PercentFormat(decimals int) ColumnFormat {
+	return numeric(func(x float64) string {
+		return strconv.FormatFloat(x*100, 'f', decimals, 64) + "%"
+	})
+}
+
+// EpochMillisFormat renders epoch-millisecond timestamps (e.g., the
+// `timestamp` attribute) as RFC3339 UTC times.
+var EpochMillisFormat = numeric(formatEpochMillis)
+
+// EpochSecondsFormat renders epoch-second timestamps as RFC3339 UTC times.
+var EpochSecondsFormat = numeric(func(x float64) string {
+	return formatEpochMillis(x * 1000)
+})
+
+// Timestamps at least this large are taken to be in milliseconds by
+// `EpochFormat`. In seconds, this is the year 5138; in milliseconds, it's
+// March 1973, well before any New Relic data.
+const epochMillisThreshold = 1e11
+
+// EpochFormat renders epoch timestamps as RFC3339 UTC times, guessing whether
+// each is in seconds or milliseconds from its magnitude.
+var EpochFormat = numeric(func(x float64) string {
+	if math.Abs(x) >= epochMillisThreshold {
+		return formatEpochMillis(x)
+	}
+	return formatEpochMillis(x * 1000)
+})
+
+func formatEpochMillis(x float64) string {
+	// Round to whole milliseconds first; scaling the float directly to
+	// nanoseconds exposes its representation error
+	ms := int64(math.Round(x))
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
+
+// `groupDigits()` inserts `sep` between each group of three digits in the
+// integer part of the number `s` (e.g., "1234567.89" becomes "1,234,567.89").
+// Anything which isn't a plain decimal number is returned unchanged.
+func groupDigits(s, sep string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i:]
+	}
+	if intPart == "" || strings.Trim(intPart, "0123456789") != "" ||
+		strings.Trim(fracPart, ".0123456789") != "" {
+		return sign + s
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, digit := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(digit)
+	}
+	b.WriteString(fracPart)
+	return b.String()
+}
+
+// `headRows()` returns the first `max` of `p`'s rows, or all of them if `max`
+// isn't positive. The rest aren't iterated over (see `IterateRows()`).
+func headRows(p Payload, max int) ([][]interface{}, error) {
+	var rows [][]interface{}
+	it := IterateRows(p)
+	for (max <= 0 || len(rows) < max) && it.Next() {
+		rows = append(rows, it.Row())
+	}
+	return rows, it.Err()
+}
+
+// `selectColumns()` projects `rows` onto `columns` (by name, in that order),
+// returning the new headers and rows. If `columns` is empty, `headers` and
+// `rows` are returned as they are.
+func selectColumns(
+	headers []string,
+	rows [][]interface{},
+	columns []string,
+) ([]string, [][]interface{}, error) {
+	if len(columns) == 0 {
+		return headers, rows, nil
+	}
+	indices, err := columnIndices(headers, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make([][]interface{}, len(rows))
+	for r, row := range rows {
+		out[r] = selectCells(row, indices)
+	}
+	return columns, out, nil
+}
+
+// `columnIndices()` returns the index in `headers` of each of `columns`, or
+// an error if one isn't there.
+func columnIndices(headers, columns []string) ([]int, error) {
+	index := make(map[string]int, len(headers))
+	for i, header := range headers {
+		if _, ok := index[header]; !ok {
+			index[header] = i // the first of any duplicates
+		}
+	}
+	indices := make([]int, len(columns))
+	for i, column := range columns {
+		var ok bool
+		if indices[i], ok = index[column]; !ok {
+			return nil, fmt.Errorf(
+				"Unknown column '%s'; the columns are: %s",
+				column,
+				strings.Join(headers, ", "),
+			)
+		}
+	}
+	return indices, nil
+}
+
+// `selectCells()` returns the cells of `row` at `indices`, in that order.
+func selectCells(row []interface{}, indices []int) []interface{} {
+	out := make([]interface{}, len(indices))
+	for i, index := range indices {
+		out[i] = cell(row, index)
+	}
+	return out
+}
+
+// `renameColumns()` returns `headers` with those in `names` renamed. The
+// original slice (which may belong to the payload) isn't modified.
+func renameColumns(headers []string, names map[string]string) []string {
+	if len(names) == 0 {
+		return headers
+	}
+	renamed := make([]string, len(headers))
+	for i, header := range headers {
+		if name, ok := names[header]; ok {
+			renamed[i] = name
+		} else {
+			renamed[i] = header
+		}
+	}
+	return renamed
+}
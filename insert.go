@@ -0,0 +1,166 @@
+package nrql
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The most events `InsertClient` sends per request. The Insert API rejects
+// payloads over 1MB (compressed), so events with many or large attributes
+// may need a smaller `InsertClient.BatchSize`.
+const MaxInsertBatchSize = 1000
+
+// The Insert API hosts, keyed by region
+var insertHosts = map[string]string{
+	"US": "insights-collector.newrelic.com",
+	"EU": "insights-collector.eu01.nr-data.net",
+}
+
+// InsertClient posts custom events to New Relic's Insights Insert API, e.g.
+// to write aggregates computed from one query back as a new event type. It
+// needs an Insert key, which is distinct from the query key.
+type InsertClient struct {
+	AccountID string
+	InsertKey string
+
+	// The New Relic region hosting the account: "US" (the default, if empty)
+	// or "EU"
+	Region string
+
+	// Sent as the User-Agent header; `DefaultUserAgent` if empty
+	UserAgent string
+
+	// Sends the requests to New Relic; `http.DefaultClient` if nil
+	HTTPClient *http.Client
+
+	// The most events per request; `MaxInsertBatchSize` if zero
+	BatchSize int
+}
+
+func (c InsertClient) host() (string, error) {
+	if c.Region == "" {
+		return insertHosts["US"], nil
+	}
+	if host, ok := insertHosts[strings.ToUpper(c.Region)]; ok {
+		return host, nil
+	}
+	return "", fmt.Errorf("Unknown New Relic region: %s", c.Region)
+}
+
+// `Insert()` posts `events` as events of type `eventType`, in gzipped batches
+// of `c.BatchSize`. The events aren't modified (their `eventType` attributes
+// are set on copies). If a batch fails, the error says how many events were
+// inserted before it.
+func (c InsertClient) Insert(
+	eventType string,
+	events []map[string]interface{},
+) error {
+	return c.InsertContext(context.Background(), eventType, events)
+}
+
+// `InsertContext()` is like `Insert()`, but the requests are aborted when
+// `ctx` is done.
+func (c InsertClient) InsertContext(
+	ctx context.Context,
+	eventType string,
+	events []map[string]interface{},
+) error {
+	if eventType == "" {
+		return fmt.Errorf("Missing event type")
+	}
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = MaxInsertBatchSize
+	}
+
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		batch := make([]map[string]interface{}, end-start)
+		for i, event := range events[start:end] {
+			batch[i] = make(map[string]interface{}, len(event)+1)
+			for k, v := range event {
+				batch[i][k] = v
+			}
+			batch[i]["eventType"] = eventType
+		}
+
+		if err := c.post(ctx, batch); err != nil {
+			return fmt.Errorf(
+				"Inserting events %d-%d of %d (%d inserted): %v",
+				start+1,
+				end,
+				len(events),
+				start,
+				err,
+			)
+		}
+	}
+	return nil
+}
+
+// `post()` sends one batch of events.
+func (c InsertClient) post(
+	ctx context.Context,
+	batch []map[string]interface{},
+) error {
+	host, err := c.host()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		fmt.Sprintf("https://%s/v1/accounts/%s/events", host, c.AccountID),
+		&body,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Insert-Key", c.InsertKey)
+	req.Header.Set("User-Agent", userAgentOr(c.UserAgent))
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf(
+			"Wanted HTTP 200; got %d: %s",
+			rsp.StatusCode,
+			data,
+		)
+	}
+	return nil
+}
@@ -6,12 +6,66 @@ import (
 )
 
 func FormatJSON(w io.Writer, p Payload) error {
+	rows, err := p.Rows()
+	if err != nil {
+		return err
+	}
 	data, err := json.Marshal(struct {
 		Columns []string
 		Rows    [][]interface{}
 	}{
 		Columns: p.Columns(),
-		Rows:    p.Rows(),
+		Rows:    rows,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// `FormatJSONNested()` is like `FormatJSON()`, but faceted results keep their
+// structure, for consumers (e.g., charting frontends) which would otherwise
+// have to reassemble it from parallel arrays:
+//
+//	{"facet": "host", "buckets": [{"name": "h1", "count(*)": 10}, ...]}
+//
+// Each bucket has the facet's value as its "name", and each aggregation under
+// its column name; an aggregation named "name" (e.g., `AS 'name'`) is renamed
+// "name_2", as repeated headers are, rather than clobbering it. Other
+// payloads are written as by `FormatJSON()`.
+func FormatJSONNested(w io.Writer, p Payload) error {
+	if p.Kind() != PayloadKindFacet {
+		return FormatJSON(w, p)
+	}
+
+	columns := p.Columns()
+	rows, err := p.Rows()
+	if err != nil {
+		return err
+	}
+
+	// The bucket keys: "name" for the facet, then the aggregations'
+	var facet string
+	keys := []string{"name"}
+	if len(columns) > 0 {
+		facet = columns[0]
+		keys = uniqueColumns(append(keys, columns[1:]...))
+	}
+
+	buckets := make([]map[string]interface{}, len(rows))
+	for r, row := range rows {
+		buckets[r] = make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			buckets[r][key] = cell(row, i)
+		}
+	}
+	data, err := json.Marshal(struct {
+		Facet   string                   `json:"facet"`
+		Buckets []map[string]interface{} `json:"buckets"`
+	}{
+		Facet:   facet,
+		Buckets: buckets,
 	})
 	if err != nil {
 		return err
@@ -19,3 +73,112 @@ func FormatJSON(w io.Writer, p Payload) error {
 	_, err = w.Write(data)
 	return err
 }
+
+// `FormatNDJSON()` writes `payload` to `w` as newline-delimited JSON: one
+// object per row, keyed by column name.
+func FormatNDJSON(w io.Writer, p Payload) error {
+	columns := p.Columns()
+	rows, err := p.Rows()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		object := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if i < len(row) {
+				object[column] = row[i]
+			}
+		}
+		if err := enc.Encode(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The column types reported by `FormatJSONSchema()`
+const (
+	JSONTypeString  = "string"
+	JSONTypeNumber  = "number"
+	JSONTypeBoolean = "boolean"
+	JSONTypeNull    = "null"
+)
+
+// `FormatJSONSchema()` is like `FormatJSON()`, but it describes each column's
+// type so loaders can create tables without guessing:
+//
+//	{"columns": [{"name": "count", "type": "number"}, ...], "rows": [...]}
+//
+// A column's type is inferred from its non-null values; a column with none is
+// "null", and a column which mixes types is widened to "string" (its values
+// are stringified to match).
+func FormatJSONSchema(w io.Writer, p Payload) error {
+	type column struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	names := p.Columns()
+	rows, err := p.Rows()
+	if err != nil {
+		return err
+	}
+
+	columns := make([]column, len(names))
+	for i, name := range names {
+		columns[i] = column{Name: name, Type: jsonColumnType(rows, i)}
+	}
+
+	// Copy the rows rather than stringifying in place; they belong to the
+	// payload. The copies are as wide as the columns, regardless of whether
+	// the originals were ragged.
+	out := make([][]interface{}, len(rows))
+	for r, row := range rows {
+		out[r] = make([]interface{}, len(columns))
+		for i, column := range columns {
+			v := cell(row, i)
+			if v != nil && column.Type == JSONTypeString {
+				v = stringify(v)
+			}
+			out[r][i] = v
+		}
+	}
+
+	data, err := json.Marshal(struct {
+		Columns []column        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}{
+		Columns: columns,
+		Rows:    out,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func jsonColumnType(rows [][]interface{}, col int) string {
+	typ := JSONTypeNull
+	for _, row := range rows {
+		v := cell(row, col)
+		if v == nil {
+			continue
+		}
+
+		cellType := JSONTypeString
+		if _, ok := v.(bool); ok {
+			cellType = JSONTypeBoolean
+		} else if _, ok := toFloat(v); ok {
+			cellType = JSONTypeNumber
+		}
+
+		if typ == JSONTypeNull {
+			typ = cellType
+		} else if typ != cellType {
+			return JSONTypeString
+		}
+	}
+	return typ
+}
@@ -0,0 +1,72 @@
+package nrql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// `formatJSONNested()` returns `p` as written by `FormatJSONNested()`,
+// decoded.
+func formatJSONNested(t *testing.T, p Payload) map[string]interface{} {
+	t.Helper()
+	var b strings.Builder
+	if err := FormatJSONNested(&b, p); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal([]byte(b.String()), &out); err != nil {
+		t.Fatalf("%v: %s", err, b.String())
+	}
+	return out
+}
+
+func TestFormatJSONNested(t *testing.T) {
+	got := formatJSONNested(t, loadFixture(t, "facet_aggregations.json"))
+	want := map[string]interface{}{
+		"facet": "host",
+		"buckets": []interface{}{
+			map[string]interface{}{
+				"name":              "web-1",
+				"count(*)":          1200.0,
+				"average(duration)": 0.31,
+				"Slowest":           4.2,
+			},
+			map[string]interface{}{
+				"name":              "web-2",
+				"count(*)":          323.0,
+				"average(duration)": 0.83,
+				"Slowest":           9.7,
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v; got %v", want, got)
+	}
+}
+
+func TestFormatJSONNestedNameColumn(t *testing.T) {
+	got := formatJSONNested(t, loadFixture(t, "facet_name_alias.json"))
+	want := []interface{}{
+		map[string]interface{}{
+			"name":     "web-1",
+			"count(*)": 1200.0,
+			"name_2":   "checkout",
+		},
+	}
+	if !reflect.DeepEqual(got["buckets"], want) {
+		t.Errorf("wanted %v; got %v", want, got["buckets"])
+	}
+}
+
+func TestFormatJSONNestedNotFaceted(t *testing.T) {
+	got := formatJSONNested(t, loadFixture(t, "aggregation.json"))
+	want := map[string]interface{}{
+		"Columns": []interface{}{"count(*)", "average(duration)"},
+		"Rows":    []interface{}{[]interface{}{1523.0, 0.42}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v; got %v", want, got)
+	}
+}
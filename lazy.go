@@ -0,0 +1,203 @@
+package nrql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A RowIterator yields a payload's rows one at a time, in the manner of
+// `bufio.Scanner`:
+//
+//	it := IterateRows(p)
+//	for it.Next() {
+//		row := it.Row()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type RowIterator interface {
+	// Advances to the next row, returning false at the end of the rows or
+	// on error
+	Next() bool
+
+	// The current row; it may be modified freely
+	Row() []interface{}
+
+	// The error which ended the rows early, if any
+	Err() error
+}
+
+// `IterateRows()` returns an iterator over `p`'s rows. If `p` yields its rows
+// one at a time (via an `IterateRows() RowIterator` method, as
+// `*LazyPayloadBasic` does), they're never all held in memory at once;
+// otherwise, they're read up front by `Rows()`.
+func IterateRows(p Payload) RowIterator {
+	if iterable, ok := p.(interface{ IterateRows() RowIterator }); ok {
+		return iterable.IterateRows()
+	}
+	rows, err := p.Rows()
+	return &sliceIterator{rows: rows, i: -1, err: err}
+}
+
+// sliceIterator iterates over rows which have already been read.
+type sliceIterator struct {
+	rows [][]interface{}
+	i    int
+	err  error
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err != nil || it.i+1 >= len(it.rows) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) Row() []interface{} {
+	return it.rows[it.i]
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+// LazyPayloadBasic is a basic payload whose events are decoded one at a time
+// as its rows are iterated (see `IterateRows()`) rather than all at once, so
+// that formatting a large result never holds all of its decoded events. The
+// response body itself is held in full: New Relic sends the metadata, and so
+// the column order, after the events. Get one from `DecodePayloadLazily()` or
+// a client with `LazyEvents` set.
+type LazyPayloadBasic struct {
+	columns []string
+	events  json.RawMessage // the JSON array of events, if any
+}
+
+// `DecodePayloadLazily()` is like `DecodePayload()`, but a basic payload (of
+// events) is returned as a `*LazyPayloadBasic`. Other payloads are decoded as
+// usual.
+func DecodePayloadLazily(r io.Reader) (Payload, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Decoding payload: %v", err)
+	}
+	return guessPayload(data, true)
+}
+
+func newLazyPayloadBasic(data []byte) (*LazyPayloadBasic, error) {
+	var basic struct {
+		Results [1]struct {
+			Events json.RawMessage `json:"events"`
+		} `json:"results"`
+		Metadata struct {
+			Contents [1]struct {
+				Columns []string `json:"columns"`
+			} `json:"contents"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &basic); err != nil {
+		return nil, err
+	}
+	p := &LazyPayloadBasic{
+		columns: basic.Metadata.Contents[0].Columns,
+		events:  basic.Results[0].Events,
+	}
+
+	// As for `PayloadBasic`, the columns of a "SELECT * ..." query are the
+	// first event's keys, in no particular order; they're evaluated once so
+	// that every row agrees with them
+	if p.columns == nil {
+		dec, err := p.decoder()
+		if err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			var first map[string]interface{}
+			if err := dec.Decode(&first); err != nil {
+				return nil, err
+			}
+			p.columns = make([]string, 0, len(first))
+			for column := range first {
+				p.columns = append(p.columns, column)
+			}
+		}
+	}
+	return p, nil
+}
+
+// `decoder()` returns a decoder positioned at the first event.
+func (p *LazyPayloadBasic) decoder() (*json.Decoder, error) {
+	events := p.events
+	if isNull(events) {
+		events = json.RawMessage("[]")
+	}
+	dec := json.NewDecoder(bytes.NewReader(events))
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('[') {
+		return nil, fmt.Errorf("Wanted a list of events; found %v", t)
+	}
+	return dec, nil
+}
+
+func (p *LazyPayloadBasic) Columns() []string {
+	return p.columns
+}
+
+// `IterateRows()` decodes the events as it goes; each call starts again from
+// the first.
+func (p *LazyPayloadBasic) IterateRows() RowIterator {
+	dec, err := p.decoder()
+	return &eventIterator{dec: dec, columns: p.columns, err: err}
+}
+
+// `Rows()` decodes every event; prefer `IterateRows()`.
+func (p *LazyPayloadBasic) Rows() ([][]interface{}, error) {
+	var rows [][]interface{}
+	it := p.IterateRows()
+	for it.Next() {
+		rows = append(rows, it.Row())
+	}
+	return rows, it.Err()
+}
+
+func (p *LazyPayloadBasic) Kind() PayloadKind {
+	return PayloadKindBasic
+}
+
+// eventIterator decodes a list of events one by one into rows.
+type eventIterator struct {
+	dec     *json.Decoder
+	columns []string
+	row     []interface{}
+	n       int // the number of events decoded
+	err     error
+}
+
+func (it *eventIterator) Next() bool {
+	if it.err != nil || !it.dec.More() {
+		return false
+	}
+	var event map[string]interface{}
+	if err := it.dec.Decode(&event); err != nil {
+		it.err = fmt.Errorf("Decoding event %d: %v", it.n, err)
+		return false
+	}
+	it.n++
+	it.row = make([]interface{}, len(it.columns))
+	for i, column := range it.columns {
+		it.row[i] = event[column]
+	}
+	return true
+}
+
+func (it *eventIterator) Row() []interface{} {
+	return it.row
+}
+
+func (it *eventIterator) Err() error {
+	return it.err
+}
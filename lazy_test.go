@@ -0,0 +1,149 @@
+package nrql
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// `loadLazyFixture()` decodes the payload saved in testdata/`name` with
+// `DecodePayloadLazily()`.
+func loadLazyFixture(t *testing.T, name string) Payload {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := DecodePayloadLazily(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// `iterate()` collects the rows of `IterateRows()`.
+func iterate(t *testing.T, p Payload) [][]interface{} {
+	t.Helper()
+	var rows [][]interface{}
+	it := IterateRows(p)
+	for it.Next() {
+		rows = append(rows, it.Row())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestDecodePayloadLazily(t *testing.T) {
+	p := loadLazyFixture(t, "events.json")
+	if _, ok := p.(*LazyPayloadBasic); !ok {
+		t.Fatalf("wanted a *LazyPayloadBasic; got %T", p)
+	}
+	want := [][]interface{}{
+		{"checkout", 0.25},
+		{"search", 1.5},
+		{"checkout", nil},
+	}
+	checkPayload(
+		t,
+		p,
+		PayloadKindBasic,
+		[]string{"appName", "duration"},
+		want,
+	)
+	for i := 0; i < 2; i++ {
+		if got := iterate(t, p); !reflect.DeepEqual(got, want) {
+			t.Errorf("iteration %d: wanted %v; got %v", i+1, want, got)
+		}
+	}
+
+	// The eager decoder agrees
+	got := iterate(t, loadFixture(t, "events.json"))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodePayload(): wanted %v; got %v", want, got)
+	}
+
+	// Other payloads are decoded as usual
+	if p := loadLazyFixture(t, "funnel.json"); p.Kind() != PayloadKindFunnel {
+		t.Errorf("wanted a funnel payload; got %s", p.Kind())
+	}
+}
+
+func TestDecodePayloadLazilySelectStar(t *testing.T) {
+	p, err := DecodePayloadLazily(strings.NewReader(
+		`{"results": [{"events": [{"a": 1, "b": "x"}, {"a": 2}]}], ` +
+			`"metadata": {"contents": [{"function": "events"}]}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := p.Columns()
+	sorted := append([]string(nil), columns...)
+	sort.Strings(sorted)
+	if !reflect.DeepEqual(sorted, []string{"a", "b"}) {
+		t.Fatalf("wanted the first event's keys; got %q", columns)
+	}
+	rows := iterate(t, p)
+	if len(rows) != 2 || len(rows[1]) != 2 {
+		t.Fatalf("wanted 2 rows of 2 cells; got %v", rows)
+	}
+	for i, column := range columns {
+		if column == "b" && rows[1][i] != nil {
+			t.Errorf("wanted a null for the missing b; got %v", rows[1][i])
+		}
+	}
+}
+
+func TestDecodePayloadLazilyErrors(t *testing.T) {
+	p, err := DecodePayloadLazily(strings.NewReader(
+		`{"results": [{"events": [{"a": 1}, "oops"]}], ` +
+			`"metadata": {"contents": [{"function": "events", ` +
+			`"columns": ["a"]}]}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := IterateRows(p)
+	if !it.Next() || it.Next() || it.Err() == nil {
+		t.Errorf("wanted one row and then an error; got %v", it.Err())
+	}
+	if _, err := p.Rows(); err == nil {
+		t.Errorf("wanted an error from Rows()")
+	}
+
+	if _, err := DecodePayloadLazily(strings.NewReader(
+		`{"error": "NRQL Syntax Error"}`,
+	)); err == nil {
+		t.Errorf("wanted an error for an error response")
+	}
+}
+
+func TestClientLazyEvents(t *testing.T) {
+	s := newEventServer(t, 5001)
+	c := s.client()
+	c.LazyEvents = true
+	p, err := c.ExecRaw("SELECT i FROM T LIMIT 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*LazyPayloadBasic); !ok {
+		t.Errorf("wanted a *LazyPayloadBasic; got %T", p)
+	}
+	checkEvents(t, iterate(t, p), 10)
+
+	// Pages are still combined
+	p, err = c.ExecAll(Query{Columns: []string{"i"}, Table: "T", Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := p.Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, rows, 5001)
+}
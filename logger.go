@@ -0,0 +1,23 @@
+package nrql
+
+// Logger is the minimal logging interface this package logs through. A
+// `*log.Logger` satisfies it, and other loggers (zap, slog, ...) need only a
+// one-method adapter. Nothing is logged unless a Logger is supplied.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// NopLogger discards everything logged to it.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// `loggerOr()` returns `l`, or `NopLogger` if `l` is nil.
+func loggerOr(l Logger) Logger {
+	if l == nil {
+		return NopLogger
+	}
+	return l
+}
@@ -0,0 +1,175 @@
+package nrql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The NerdGraph endpoints, keyed by region
+var nerdGraphURLs = map[string]string{
+	"US": "https://api.newrelic.com/graphql",
+	"EU": "https://api.eu.newrelic.com/graphql",
+}
+
+// `rawResponse` is the same JSON document the Insights query API returns, so
+// it can be decoded by `unmarshalPayload()` unchanged.
+const nerdGraphQuery = `query($accountId: Int!, $nrql: Nrql!) {
+	actor {
+		account(id: $accountId) {
+			nrql(query: $nrql) {
+				rawResponse
+			}
+		}
+	}
+}`
+
+// NerdGraphClient is an alternative to `Client` which queries via New Relic's
+// NerdGraph (GraphQL) API rather than the Insights query API. It has the same
+// `Exec()`/`ExecRaw()` surface and produces the same `Payload` types, but it
+// authenticates with a user API key rather than a query key.
+type NerdGraphClient struct {
+	AccountID string
+	APIKey    string
+
+	// The New Relic region hosting the account: "US" (the default, if empty)
+	// or "EU"
+	Region string
+
+	// Sent as the User-Agent header; `DefaultUserAgent` if empty
+	UserAgent string
+}
+
+func (c NerdGraphClient) endpoint() (string, error) {
+	region := strings.ToUpper(c.Region)
+	if region == "" {
+		region = "US"
+	}
+	if endpoint, ok := nerdGraphURLs[region]; ok {
+		return endpoint, nil
+	}
+	return "", fmt.Errorf("Unknown New Relic region: %s", c.Region)
+}
+
+func (c NerdGraphClient) Exec(q Query) (Payload, error) {
+	return c.ExecContext(context.Background(), q)
+}
+
+func (c NerdGraphClient) ExecRaw(nrql string) (Payload, error) {
+	return c.ExecRawContext(context.Background(), nrql)
+}
+
+// `ExecContext()` is like `Exec()`, but the request is aborted when `ctx` is
+// done.
+func (c NerdGraphClient) ExecContext(ctx context.Context, q Query) (Payload, error) {
+	return c.ExecRawContext(ctx, q.String())
+}
+
+// `ExecRawContext()` is like `ExecRaw()`, but the request is aborted when
+// `ctx` is done.
+func (c NerdGraphClient) ExecRawContext(
+	ctx context.Context,
+	nrql string,
+) (Payload, error) {
+	endpoint, err := c.endpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	// GraphQL wants the account ID as an integer
+	accountID, err := strconv.Atoi(c.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid account ID '%s': %v", c.AccountID, err)
+	}
+
+	body, err := json.Marshal(struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}{
+		Query: nerdGraphQuery,
+		Variables: map[string]interface{}{
+			"accountId": accountID,
+			"nrql":      nrql,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build a new request
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		endpoint,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the requisite headers
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("API-Key", c.APIKey)
+	req.Header.Set("User-Agent", userAgentOr(c.UserAgent))
+
+	// Dispatch the request
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close() // close the http body when done
+
+	// Read the body into memory
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the status code
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"Wanted HTTP 200; got %d: %s",
+			rsp.StatusCode,
+			data,
+		)
+	}
+
+	// GraphQL reports errors (including NRQL syntax errors) in the body of
+	// an HTTP 200 response
+	var result struct {
+		Data struct {
+			Actor struct {
+				Account struct {
+					NRQL *struct {
+						RawResponse json.RawMessage `json:"rawResponse"`
+					} `json:"nrql"`
+				} `json:"account"`
+			} `json:"actor"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("Decoding NerdGraph response: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, len(result.Errors))
+		for i, e := range result.Errors {
+			messages[i] = e.Message
+		}
+		return nil, fmt.Errorf("NerdGraph: %s", strings.Join(messages, "; "))
+	}
+	nrqlResult := result.Data.Actor.Account.NRQL
+	if nrqlResult == nil || len(nrqlResult.RawResponse) == 0 {
+		return nil, fmt.Errorf("NerdGraph response has no results: %s", data)
+	}
+
+	return unmarshalPayload(nrqlResult.RawResponse)
+}
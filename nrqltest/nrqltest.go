@@ -0,0 +1,121 @@
+// Package nrqltest provides a fake `nrql.Querier` for testing code which
+// queries New Relic, without touching the network.
+package nrqltest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	nrql "github.com/ns-cweber/nrql2csv"
+)
+
+// Table is a canned payload with fixed columns and rows.
+type Table struct {
+	Header []string
+	Data   [][]interface{}
+
+	// The kind of payload it stands in for; `nrql.PayloadKindBasic` if zero
+	PayloadKind nrql.PayloadKind
+}
+
+func (t Table) Columns() []string {
+	return t.Header
+}
+
+// `Rows()` returns a copy of `t.Data`, so callers may modify it freely.
+func (t Table) Rows() ([][]interface{}, error) {
+	rows := make([][]interface{}, len(t.Data))
+	for i, row := range t.Data {
+		rows[i] = append([]interface{}(nil), row...)
+	}
+	return rows, nil
+}
+
+func (t Table) Kind() nrql.PayloadKind {
+	if t.PayloadKind == nrql.PayloadKindUnknown {
+		return nrql.PayloadKindBasic
+	}
+	return t.PayloadKind
+}
+
+// FakeClient is an `nrql.Querier` which answers queries from canned payloads
+// (or errors), keyed by their NRQL, and records the queries it was asked. A
+// query with no canned answer is an error. It's safe for concurrent use.
+type FakeClient struct {
+	lock     sync.Mutex
+	payloads map[string]nrql.Payload
+	errors   map[string]error
+	queries  []string
+}
+
+var _ nrql.Querier = (*FakeClient)(nil)
+
+// `NewFakeClient()` returns a client with no canned answers.
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		payloads: map[string]nrql.Payload{},
+		errors:   map[string]error{},
+	}
+}
+
+// `Respond()` makes `p` the answer to `query`; structured queries are matched
+// by their `String()`.
+func (c *FakeClient) Respond(query string, p nrql.Payload) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.payloads[query] = p
+	delete(c.errors, query)
+}
+
+// `Fail()` makes `err` the answer to `query`.
+func (c *FakeClient) Fail(query string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errors[query] = err
+	delete(c.payloads, query)
+}
+
+// `Queries()` returns the NRQL of every query asked so far, in order.
+func (c *FakeClient) Queries() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+func (c *FakeClient) Exec(q nrql.Query) (nrql.Payload, error) {
+	return c.ExecRawContext(context.Background(), q.String())
+}
+
+func (c *FakeClient) ExecRaw(query string) (nrql.Payload, error) {
+	return c.ExecRawContext(context.Background(), query)
+}
+
+func (c *FakeClient) ExecContext(
+	ctx context.Context,
+	q nrql.Query,
+) (nrql.Payload, error) {
+	return c.ExecRawContext(ctx, q.String())
+}
+
+// `ExecRawContext()` returns the canned answer for `query`, or `ctx`'s error
+// if it's already done (as a real request would).
+func (c *FakeClient) ExecRawContext(
+	ctx context.Context,
+	query string,
+) (nrql.Payload, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queries = append(c.queries, query)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err, ok := c.errors[query]; ok {
+		return nil, err
+	}
+	if p, ok := c.payloads[query]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("nrqltest: no answer for query '%s'", query)
+}
@@ -0,0 +1,68 @@
+package nrql
+
+import "net/http"
+
+// An Option configures a client built by `NewClient()`. Each sets the
+// corresponding `Client` field, which may still be set directly; options are
+// simply immune to fields being added.
+type Option func(*Client)
+
+// `WithRegion()` sets the New Relic region hosting the account: "US" or "EU".
+func WithRegion(region string) Option {
+	return func(c *Client) { c.Region = region }
+}
+
+// `WithBaseURL()` sends the requests to `baseURL` (e.g., a proxy) rather than
+// the region's API host.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) { c.BaseURL = baseURL }
+}
+
+// `WithPathTemplate()` sets the path of the query endpoint, in which
+// "{account_id}" stands for the account ID.
+func WithPathTemplate(template string) Option {
+	return func(c *Client) { c.PathTemplate = template }
+}
+
+// `WithUserAgent()` sets the User-Agent header sent with each request.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.UserAgent = userAgent }
+}
+
+// `WithHTTPClient()` sends the requests with `httpClient` (e.g., one with a
+// proxy or a timeout) rather than `http.DefaultClient`.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.HTTPClient = httpClient }
+}
+
+// `WithRetry()` retries transient failures according to `policy`.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Client) { c.Retry = policy }
+}
+
+// `WithMaxResponseSize()` abandons responses larger than `n` bytes.
+func WithMaxResponseSize(n int64) Option {
+	return func(c *Client) { c.MaxResponseSize = n }
+}
+
+// `WithCache()` caches responses in `cache`.
+func WithCache(cache *Cache) Option {
+	return func(c *Client) { c.Cache = cache }
+}
+
+// `WithRateLimiter()` throttles requests with `limiter` (which may be shared
+// with other clients).
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(c *Client) { c.Limiter = limiter }
+}
+
+// `WithLogger()` logs a summary of each request (and retry) to `logger`.
+func WithLogger(logger Logger) Option {
+	return func(c *Client) { c.Logger = logger }
+}
+
+// `WithLazyEvents()` returns basic payloads as `*LazyPayloadBasic`s, which
+// decode their events as their rows are iterated.
+func WithLazyEvents() Option {
+	return func(c *Client) { c.LazyEvents = true }
+}
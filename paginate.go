@@ -0,0 +1,157 @@
+package nrql
+
+import (
+	"context"
+	"fmt"
+)
+
+// The most results New Relic returns for a single query (i.e., `LIMIT MAX`),
+// and so the page size of `ExecAll()`
+const MaxPageSize = 5000
+
+// `ExecAll()` is like `Exec()`, but it gets around the cap on the number of
+// results a single query may return by fetching them page by page (with LIMIT
+// and OFFSET) until a short page signals the end, and returns them all as a
+// single payload. A non-negative `q.Limit` caps the total rather than the page
+// size (`q.LimitMax` and a negative `q.Limit` fetch everything), and the pages
+// start from `q.Offset`.
+//
+// Only queries which return events (rather than aggregations) are paged; any
+// other query is run as given, and its results are returned. Set `q.Until` so
+// that events arriving mid-extract don't shift the pages. Progress is reported
+// via `c.OnPage`, if set.
+func (c Client) ExecAll(q Query) (Payload, error) {
+	return c.ExecAllContext(context.Background(), q)
+}
+
+// `ExecAllContext()` is like `ExecAll()`, but the requests are aborted when
+// `ctx` is done.
+func (c Client) ExecAllContext(ctx context.Context, q Query) (Payload, error) {
+	p, _, err := c.execAll(ctx, q, false)
+	return p, err
+}
+
+// `ExecAllUntil()` is like `ExecAllContext()`, but it makes the best of a
+// deadline (or cancellation): once `ctx` is done, it returns the pages
+// fetched so far rather than an error, with `truncated` set. This suits
+// callers with a hard time budget, e.g. "as many rows as possible in 30
+// seconds". It's still an error if not even the first page was fetched.
+func (c Client) ExecAllUntil(
+	ctx context.Context,
+	q Query,
+) (p Payload, truncated bool, err error) {
+	return c.execAll(ctx, q, true)
+}
+
+// `execAll()` implements `ExecAllContext()` and (if `partial`)
+// `ExecAllUntil()`.
+func (c Client) execAll(
+	ctx context.Context,
+	q Query,
+	partial bool,
+) (Payload, bool, error) {
+	c.LazyEvents = false // the pages are combined
+	pages := pager{q: q}
+	p, pageable, err := c.firstPage(ctx, &pages)
+	if err != nil || !pageable {
+		return p, false, err
+	}
+
+	all := p.(*PayloadBasic)
+	pages.add(len(all.Results[0].Events))
+	if c.OnPage != nil {
+		c.OnPage(1, len(all.Results[0].Events))
+	}
+	for page := 2; ; page++ {
+		pq, ok := pages.next()
+		if !ok {
+			return all, false, nil
+		}
+		p, err := c.ExecContext(ctx, pq)
+		if err != nil {
+			if partial && ctx.Err() != nil {
+				return all, true, nil
+			}
+			return nil, false, err
+		}
+
+		basic, ok := p.(*PayloadBasic)
+		if !ok {
+			return nil, false, fmt.Errorf(
+				"Page %d of '%s' is a %s payload; wanted events",
+				page,
+				pq,
+				p.Kind(),
+			)
+		}
+
+		events := basic.Results[0].Events
+		all.Results[0].Events = append(all.Results[0].Events, events...)
+		pages.add(len(events))
+		if c.OnPage != nil {
+			c.OnPage(page, len(all.Results[0].Events))
+		}
+	}
+}
+
+// pager works out the pages of a query's events for `ExecAll()` and
+// `Stream()`. The query's own LIMIT caps the total, unless it's negative or
+// `LimitMax`, and its OFFSET is that of the first page.
+type pager struct {
+	q       Query // as given
+	fetched int   // the number of events on the pages so far
+	size    int   // the LIMIT of the latest page
+	done    bool
+}
+
+// `limited()` returns true if the query's LIMIT caps the total.
+func (p *pager) limited() bool {
+	return !p.q.LimitMax && p.q.Limit >= 0
+}
+
+// `next()` returns the query for the next page, or false if there are no
+// more.
+func (p *pager) next() (Query, bool) {
+	if p.done {
+		return Query{}, false
+	}
+	p.size = MaxPageSize
+	if p.limited() && p.q.Limit-p.fetched < p.size {
+		p.size = p.q.Limit - p.fetched
+	}
+	q := p.q
+	q.Limit = p.size
+	q.LimitMax = false
+	q.Offset = p.q.Offset + p.fetched
+	return q, true
+}
+
+// `add()` records that the latest page held `n` events. A short page is the
+// last, as is the one which reaches the limit.
+func (p *pager) add(n int) {
+	p.fetched += n
+	p.done = n < p.size || p.limited() && p.fetched >= p.q.Limit
+}
+
+// `firstPage()` fetches the first of `pages`, and returns whether there may be
+// more (i.e., it's a page of events). If it isn't, the query is re-issued as
+// given (unless that's the query which was just run), since the page's LIMIT
+// would otherwise have replaced the query's own, e.g. the number of facets.
+func (c Client) firstPage(
+	ctx context.Context,
+	pages *pager,
+) (Payload, bool, error) {
+	q, _ := pages.next()
+	p, err := c.ExecContext(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, ok := p.(*PayloadBasic); ok {
+		return p, true, nil
+	}
+	if q.String() == pages.q.String() {
+		return p, false, nil
+	}
+	p, err = c.ExecContext(ctx, pages.q)
+	return p, false, err
+}
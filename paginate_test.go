@@ -0,0 +1,218 @@
+package nrql
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The results of `eventServer`'s faceted queries
+const testFacetPayload = `{
+	"facets": [{"name": "a", "results": [{"count": 1}]}],
+	"metadata": {
+		"facet": "appName",
+		"contents": {"contents": [{"function": "count", "attribute": "*"}]}
+	}
+}`
+
+var limitOffset = regexp.MustCompile(`LIMIT (\d+)(?: OFFSET (\d+))?$`)
+
+// eventServer stands in for New Relic's query API, holding `events` events
+// (numbered from 0) which it pages by its queries' LIMIT and OFFSET. Faceted
+// queries get `testFacetPayload`. It records the queries it's sent.
+type eventServer struct {
+	*httptest.Server
+	events int
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func newEventServer(t *testing.T, events int) *eventServer {
+	s := &eventServer{events: events}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *eventServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	nrql := r.URL.Query().Get("nrql")
+	s.mu.Lock()
+	s.queries = append(s.queries, nrql)
+	s.mu.Unlock()
+
+	if strings.Contains(nrql, " FACET ") {
+		fmt.Fprint(w, testFacetPayload)
+		return
+	}
+	limit, offset := 100, 0 // New Relic's default LIMIT
+	if m := limitOffset.FindStringSubmatch(nrql); m != nil {
+		limit, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			offset, _ = strconv.Atoi(m[2])
+		}
+	}
+	events := make([]string, 0, limit)
+	for i := offset; i < s.events && i < offset+limit; i++ {
+		events = append(events, fmt.Sprintf(`{"i": %d}`, i))
+	}
+	fmt.Fprintf(
+		w,
+		`{"results": [{"events": [%s]}], `+
+			`"metadata": {"contents": [{"function": "events", `+
+			`"columns": ["i"]}]}}`,
+		strings.Join(events, ", "),
+	)
+}
+
+func (s *eventServer) client() Client {
+	return Client{AccountID: "1", QueryKey: "key", BaseURL: s.URL}
+}
+
+// `sent()` returns the queries the server has been sent, in order.
+func (s *eventServer) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// `checkEvents()` fails the test unless `rows` are events 0 through `n`-1.
+func checkEvents(t *testing.T, rows [][]interface{}, n int) {
+	t.Helper()
+	if len(rows) != n {
+		t.Fatalf("wanted %d rows; got %d", n, len(rows))
+	}
+	for i, row := range rows {
+		if !reflect.DeepEqual(row, []interface{}{float64(i)}) {
+			t.Fatalf("row %d: got %v", i, row)
+		}
+	}
+}
+
+func TestExecAllPages(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		events int
+		limit  int
+		max    bool
+		offset int
+		want   []string // the LIMIT and OFFSET of each query
+		rows   int
+	}{
+		{
+			name:   "unlimited",
+			events: 12001,
+			limit:  -1,
+			want: []string{
+				"LIMIT 5000",
+				"LIMIT 5000 OFFSET 5000",
+				"LIMIT 5000 OFFSET 10000",
+			},
+			rows: 12001,
+		},
+		{
+			name:   "LIMIT MAX",
+			events: 5000,
+			max:    true,
+			want:   []string{"LIMIT 5000", "LIMIT 5000 OFFSET 5000"},
+			rows:   5000,
+		},
+		{
+			name:   "limit over a page",
+			events: 12001,
+			limit:  7000,
+			want:   []string{"LIMIT 5000", "LIMIT 2000 OFFSET 5000"},
+			rows:   7000,
+		},
+		{
+			name:   "limit within a page",
+			events: 12001,
+			limit:  10,
+			want:   []string{"LIMIT 10"},
+			rows:   10,
+		},
+		{
+			name:   "offset",
+			events: 6000,
+			limit:  -1,
+			offset: 2000,
+			want:   []string{"LIMIT 5000 OFFSET 2000"},
+			rows:   4000,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newEventServer(t, c.events)
+			p, err := s.client().ExecAll(Query{
+				Columns:  []string{"i"},
+				Table:    "T",
+				Limit:    c.limit,
+				LimitMax: c.max,
+				Offset:   c.offset,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]string, len(c.want))
+			for i, clause := range c.want {
+				want[i] = "SELECT i FROM T " + clause
+			}
+			if got := s.sent(); !reflect.DeepEqual(got, want) {
+				t.Errorf("wanted queries %q; got %q", want, got)
+			}
+			rows, err := p.Rows()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != c.rows {
+				t.Fatalf("wanted %d rows; got %d", c.rows, len(rows))
+			}
+			if c.offset == 0 {
+				checkEvents(t, rows, c.rows)
+			}
+		})
+	}
+}
+
+func TestExecAllAggregationKeepsLimit(t *testing.T) {
+	s := newEventServer(t, 0)
+	q := Query{
+		Columns: []string{"count(*)"},
+		Table:   "T",
+		Facet:   "appName",
+		Limit:   20,
+	}
+	p, err := s.client().ExecAllContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Kind() != PayloadKindFacet {
+		t.Errorf("wanted a facet payload; got %s", p.Kind())
+	}
+	want := []string{
+		"SELECT count(*) FROM T FACET appName LIMIT 20",
+	}
+	if got := s.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted queries %q; got %q", want, got)
+	}
+
+	// A page's LIMIT would replace the query's own, so it's re-issued
+	s = newEventServer(t, 0)
+	q.Limit = -1
+	if _, err := s.client().ExecAll(q); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"SELECT count(*) FROM T FACET appName LIMIT 5000",
+		"SELECT count(*) FROM T FACET appName",
+	}
+	if got := s.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted queries %q; got %q", want, got)
+	}
+}
@@ -0,0 +1,327 @@
+package nrql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// This file implements just enough of the Parquet format to write a payload:
+// a single row group, with one uncompressed, PLAIN-encoded data page per
+// column. Every column is OPTIONAL, so nulls are encoded as nulls rather than
+// as empty strings. The file metadata is serialized with Thrift's compact
+// protocol, which is implemented (minimally) below as well. See
+// https://github.com/apache/parquet-format for the specification.
+
+const parquetMagic = "PAR1"
+
+// Parquet enum values
+const (
+	parquetDouble    = 5 // Type.DOUBLE
+	parquetByteArray = 6 // Type.BYTE_ARRAY
+
+	parquetOptional = 1 // FieldRepetitionType.OPTIONAL
+	parquetUTF8     = 0 // ConvertedType.UTF8
+
+	parquetPlain = 0 // Encoding.PLAIN
+	parquetRLE   = 3 // Encoding.RLE
+
+	parquetUncompressed = 0 // CompressionCodec.UNCOMPRESSED
+	parquetDataPage     = 0 // PageType.DATA_PAGE
+)
+
+// The MIME type of the output of `FormatParquet()`
+const ParquetContentType = "application/vnd.apache.parquet"
+
+// `FormatParquet()` writes `payload` to `w` as a Parquet file. Each column is
+// typed as a double if all of its non-null values are numeric, and as a
+// (UTF-8) string otherwise, so a column which mixes numbers and strings loses
+// nothing.
+func FormatParquet(w io.Writer, payload Payload) error {
+	headers := payload.Columns()
+	rows, err := payload.Rows()
+	if err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, parquetMagic); err != nil {
+		return err
+	}
+
+	chunks := make([]parquetChunk, len(headers))
+	for i, header := range headers {
+		chunk := parquetChunk{name: header, typ: parquetColumnType(rows, i)}
+		page := parquetPage(rows, i, chunk.typ)
+		pageHeader := parquetPageHeader(len(rows), len(page))
+
+		chunk.offset = cw.n
+		chunk.size = int64(len(pageHeader) + len(page))
+		if _, err := cw.Write(pageHeader); err != nil {
+			return err
+		}
+		if _, err := cw.Write(page); err != nil {
+			return err
+		}
+		chunks[i] = chunk
+	}
+
+	footer := parquetFileMetaData(chunks, len(rows))
+	if _, err := cw.Write(footer); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	if _, err := cw.Write(length[:]); err != nil {
+		return err
+	}
+	_, err = io.WriteString(cw, parquetMagic)
+	return err
+}
+
+// Tracks the number of bytes written, for the offsets in the file metadata
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// A column chunk which has been written, as described by the file metadata
+type parquetChunk struct {
+	name   string
+	typ    int32
+	offset int64
+	size   int64
+}
+
+// `parquetColumnType()` returns DOUBLE if every non-null value in the column
+// is numeric (and there's at least one), and BYTE_ARRAY otherwise. This looks
+// at every value rather than only the first non-null one: a column typed by
+// its first value could hold later values of the other type, which a DOUBLE
+// column can't represent, and New Relic's attributes aren't consistently
+// typed from one event to the next.
+func parquetColumnType(rows [][]interface{}, col int) int32 {
+	if isNumericColumn(rows, col) {
+		return parquetDouble
+	}
+	return parquetByteArray
+}
+
+// `parquetPage()` encodes a column's definition levels and values. The
+// definition levels (1 for a value, 0 for a null) use the RLE/bit-packing
+// hybrid encoding, here as a series of RLE runs, prefixed by their length.
+// The non-null values follow, PLAIN-encoded.
+func parquetPage(rows [][]interface{}, col int, typ int32) []byte {
+	var levels bytes.Buffer
+	for i := 0; i < len(rows); {
+		defined := cell(rows[i], col) != nil
+		run := 1
+		for i+run < len(rows) && (cell(rows[i+run], col) != nil) == defined {
+			run++
+		}
+		writeUvarint(&levels, uint64(run)<<1) // the low bit 0 denotes RLE
+		if defined {
+			levels.WriteByte(1)
+		} else {
+			levels.WriteByte(0)
+		}
+		i += run
+	}
+
+	var page bytes.Buffer
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(levels.Len()))
+	page.Write(length[:])
+	page.Write(levels.Bytes())
+
+	var scratch [8]byte
+	for _, row := range rows {
+		v := cell(row, col)
+		if v == nil {
+			continue
+		}
+		if typ == parquetDouble {
+			x, _ := toFloat(v)
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(x))
+			page.Write(scratch[:])
+			continue
+		}
+		s := stringify(v)
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(s)))
+		page.Write(scratch[:4])
+		page.WriteString(s)
+	}
+	return page.Bytes()
+}
+
+func parquetPageHeader(numValues, size int) []byte {
+	var t thriftWriter
+	t.begin()
+	t.i32Field(1, parquetDataPage)
+	t.i32Field(2, int32(size)) // uncompressed_page_size
+	t.i32Field(3, int32(size)) // compressed_page_size
+	t.structField(5)           // data_page_header
+	t.i32Field(1, int32(numValues))
+	t.i32Field(2, parquetPlain) // encoding
+	t.i32Field(3, parquetRLE)   // definition_level_encoding
+	t.i32Field(4, parquetRLE)   // repetition_level_encoding
+	t.end()
+	t.end()
+	return t.buf.Bytes()
+}
+
+func parquetFileMetaData(chunks []parquetChunk, numRows int) []byte {
+	var t thriftWriter
+	t.begin()
+	t.i32Field(1, 1) // version
+
+	// The schema is flattened depth-first; the root element's only job is to
+	// say how many columns follow it
+	t.listField(2, thriftStruct, len(chunks)+1)
+	t.begin()
+	t.binaryField(4, "schema")
+	t.i32Field(5, int32(len(chunks))) // num_children
+	t.end()
+	for _, chunk := range chunks {
+		t.begin()
+		t.i32Field(1, chunk.typ)
+		t.i32Field(3, parquetOptional)
+		t.binaryField(4, chunk.name)
+		if chunk.typ == parquetByteArray {
+			t.i32Field(6, parquetUTF8)
+		}
+		t.end()
+	}
+
+	t.i64Field(3, int64(numRows))
+
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.size
+	}
+
+	t.listField(4, thriftStruct, 1) // row_groups
+	t.begin()
+	t.listField(1, thriftStruct, len(chunks)) // columns
+	for _, chunk := range chunks {
+		t.begin()
+		t.i64Field(2, chunk.offset) // file_offset
+		t.structField(3)            // meta_data
+		t.i32Field(1, chunk.typ)
+		t.listField(2, thriftI32, 2) // encodings
+		t.i32(parquetPlain)
+		t.i32(parquetRLE)
+		t.listField(3, thriftBinary, 1) // path_in_schema
+		t.binary(chunk.name)
+		t.i32Field(4, parquetUncompressed)
+		t.i64Field(5, int64(numRows))
+		t.i64Field(6, chunk.size) // total_uncompressed_size
+		t.i64Field(7, chunk.size) // total_compressed_size
+		t.i64Field(9, chunk.offset)
+		t.end()
+		t.end()
+	}
+	t.i64Field(2, totalSize)
+	t.i64Field(3, int64(numRows))
+	t.end()
+
+	t.binaryField(6, "nrql2csv version "+Version) // created_by
+	t.end()
+	return t.buf.Bytes()
+}
+
+// Thrift compact protocol type codes
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// A minimal Thrift compact protocol encoder. Struct field headers encode the
+// field ID as a delta from the previous field in the same struct, so the
+// writer keeps a stack of the last field ID in each open struct. Every struct
+// (including the outermost one, and each struct element of a list) must be
+// bracketed by `begin()` and `end()`.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0) // stop
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		writeUvarint(&t.buf, zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(v int32) {
+	writeUvarint(&t.buf, zigzag(int64(v)))
+}
+
+func (t *thriftWriter) binary(s string) {
+	writeUvarint(&t.buf, uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	writeUvarint(&t.buf, zigzag(v))
+}
+
+func (t *thriftWriter) binaryField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(s)
+}
+
+// `structField()` opens a nested struct; close it with `end()`.
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.begin()
+}
+
+// `listField()` starts a list of `size` elements of type `elem`, which the
+// caller must write next.
+func (t *thriftWriter) listField(id int16, elem byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		writeUvarint(&t.buf, uint64(size))
+	}
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+}
@@ -0,0 +1,335 @@
+package nrql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The clauses `ParseQuery()` understands. SLIDE is always followed by BY.
+var clauseKeywords = map[string]bool{
+	"SELECT":      true,
+	"FROM":        true,
+	"WHERE":       true,
+	"SINCE":       true,
+	"UNTIL":       true,
+	"FACET":       true,
+	"LIMIT":       true,
+	"OFFSET":      true,
+	"TIMESERIES":  true,
+	"SLIDE":       true,
+	"EXTRAPOLATE": true,
+}
+
+// The keywords of clauses which `Query` has no field for (e.g., COMPARE WITH,
+// WITH TIMEZONE, ORDER BY); rather than silently drop them, `ParseQuery()`
+// refuses queries which use them.
+var unsupportedKeywords = map[string]bool{
+	"COMPARE": true,
+	"WITH":    true,
+	"ORDER":   true,
+	"JOIN":    true,
+}
+
+// A clause keyword found in an NRQL statement, and where it was found
+type clause struct {
+	keyword    string // upper-cased
+	start, end int    // the byte offsets of the keyword itself
+}
+
+// `ParseQuery()` parses an NRQL statement into a `Query`. It understands the
+// clauses `Query` can represent (SELECT, FROM, WHERE, SINCE, UNTIL, FACET,
+// LIMIT, OFFSET, TIMESERIES, SLIDE BY and EXTRAPOLATE), in any order, and
+// returns an error for anything else rather than dropping it. Of two LIMIT
+// clauses, one directly after FACET is the `FacetLimit`; a lone LIMIT is
+// always the `Limit`. Clause bodies are kept verbatim, except that quoted
+// SINCE and UNTIL timestamps are unquoted (they're quoted again by `String()`)
+// and `SELECT *` yields nil `Columns`. FROM must be a list of event types, and
+// SINCE and UNTIL must be relative, epoch or quoted timestamps; anything else
+// in them (e.g., SHOW EVENT TYPES or AS OF) is an error.
+//
+// `ParseQuery(q.String())` yields `q` for queries built by this package, with
+// the exception of `WhereClause`, which is folded into `Where`, `SinceTime`
+// and `UntilTime`, which come back as epoch milliseconds in `Since` and
+// `Until`, and a `FacetLimit` without a `Limit`, which comes back as the
+// `Limit`.
+func ParseQuery(nrql string) (Query, error) {
+	q := Query{Limit: -1}
+
+	statement := strings.TrimSuffix(strings.TrimSpace(nrql), ";")
+	clauses := findClauses(statement)
+	if len(clauses) == 0 {
+		return Query{}, fmt.Errorf("Missing SELECT clause in '%s'", nrql)
+	}
+	if prefix := strings.TrimSpace(statement[:clauses[0].start]); prefix != "" {
+		return Query{}, fmt.Errorf("Unexpected '%s' in '%s'", prefix, nrql)
+	}
+
+	facetLimitAt := findFacetLimit(clauses)
+	seen := map[string]bool{}
+	for i, c := range clauses {
+		if unsupportedKeywords[c.keyword] {
+			return Query{}, fmt.Errorf("Unsupported NRQL clause: %s", c.keyword)
+		}
+		if i == facetLimitAt {
+			c.keyword = "FACET LIMIT"
+		}
+		if seen[c.keyword] {
+			return Query{}, fmt.Errorf("Duplicate %s clause", c.keyword)
+		}
+		seen[c.keyword] = true
+
+		end := len(statement)
+		if i+1 < len(clauses) {
+			end = clauses[i+1].start
+		}
+		body := strings.TrimSpace(statement[c.end:end])
+		if body == "" && c.keyword != "EXTRAPOLATE" {
+			return Query{}, fmt.Errorf("Empty %s clause", c.keyword)
+		}
+
+		switch c.keyword {
+		case "SELECT":
+			if body == "*" {
+				break
+			}
+			for _, column := range splitTopLevel(body) {
+				if column = strings.TrimSpace(column); column == "" {
+					return Query{}, fmt.Errorf("Empty column in '%s'", body)
+				}
+				q.Columns = append(q.Columns, column)
+			}
+		case "FROM":
+			if !isTableList(body) {
+				return Query{}, fmt.Errorf("Unsupported FROM: %s", body)
+			}
+			q.Table = body
+		case "WHERE":
+			q.Where = body
+		case "SINCE":
+			since, err := parseTimeExpr(c.keyword, body)
+			if err != nil {
+				return Query{}, err
+			}
+			q.Since = since
+		case "UNTIL":
+			until, err := parseTimeExpr(c.keyword, body)
+			if err != nil {
+				return Query{}, err
+			}
+			q.Until = until
+		case "FACET":
+			q.Facet = body
+		case "FACET LIMIT":
+			limit, err := strconv.Atoi(body)
+			if err != nil || limit <= 0 {
+				return Query{}, fmt.Errorf("Invalid FACET LIMIT: %s", body)
+			}
+			q.FacetLimit = limit
+		case "LIMIT":
+			if strings.EqualFold(body, "MAX") {
+				q.LimitMax = true
+				break
+			}
+			limit, err := strconv.Atoi(body)
+			if err != nil || limit < 0 {
+				return Query{}, fmt.Errorf("Invalid LIMIT: %s", body)
+			}
+			q.Limit = limit
+		case "OFFSET":
+			offset, err := strconv.Atoi(body)
+			if err != nil || offset < 0 {
+				return Query{}, fmt.Errorf("Invalid OFFSET: %s", body)
+			}
+			q.Offset = offset
+		case "TIMESERIES":
+			q.TimeSeries = body
+		case "SLIDE":
+			fields := strings.Fields(body)
+			if len(fields) < 2 || !strings.EqualFold(fields[0], "BY") {
+				return Query{}, fmt.Errorf(
+					"Expected SLIDE BY; got SLIDE %s",
+					body,
+				)
+			}
+			q.SlideBy = strings.TrimSpace(body[len(fields[0]):])
+		case "EXTRAPOLATE":
+			if body != "" {
+				return Query{}, fmt.Errorf(
+					"Unexpected '%s' after EXTRAPOLATE",
+					body,
+				)
+			}
+			q.Extrapolate = true
+		}
+	}
+
+	if !seen["SELECT"] {
+		return Query{}, fmt.Errorf("Missing SELECT clause in '%s'", nrql)
+	}
+	if err := q.Validate(); err != nil {
+		return Query{}, err
+	}
+	return q, nil
+}
+
+// `parseTimeExpr()` returns the value of the SINCE or UNTIL clause (per
+// `keyword`) whose body is `body`, which must be in one of the forms
+// `timeExpr()` renders: a relative expression, an epoch timestamp, or a quoted
+// absolute timestamp (which is unquoted). Anything else (e.g., a trailing AS
+// OF) is an error, rather than being folded into the value.
+func parseTimeExpr(keyword, body string) (string, error) {
+	switch {
+	case isEpoch(body):
+		return body, nil
+	case isQuotedString(body):
+		return unquoteString(body), nil
+	case isRelativeTime(body):
+		if err := checkRelativeTime(body); err != nil {
+			return "", fmt.Errorf("Invalid %s: %v", keyword, err)
+		}
+		return body, nil
+	}
+	return "", fmt.Errorf("Unsupported %s: %s", keyword, body)
+}
+
+// `isQuotedString()` returns true if `s` is a single string quoted as by
+// `quoteString()`, with no unescaped quotes inside.
+func isQuotedString(s string) bool {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return false
+	}
+	for i := 1; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '\'':
+			return false
+		}
+	}
+	return true
+}
+
+// `isTableList()` returns true if `s` is an event type (e.g., "Transaction"
+// or "`My Events`") or a comma-separated list of them.
+func isTableList(s string) bool {
+	for _, table := range strings.Split(s, ",") {
+		table = strings.TrimSpace(table)
+		if len(table) > 1 && table[0] == '`' && table[len(table)-1] == '`' &&
+			!strings.Contains(table[1:len(table)-1], "`") {
+			continue
+		}
+		if table == "" {
+			return false
+		}
+		for i := 0; i < len(table); i++ {
+			if !isWordByte(table[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// `findFacetLimit()` returns the index of the LIMIT clause which limits the
+// facets rather than the results, or -1 if there isn't one. That's only
+// told apart by there being two LIMIT clauses, the first directly after FACET.
+func findFacetLimit(clauses []clause) int {
+	var limits []int
+	for i, c := range clauses {
+		if c.keyword == "LIMIT" {
+			limits = append(limits, i)
+		}
+	}
+	if len(limits) == 2 && limits[0] > 0 &&
+		clauses[limits[0]-1].keyword == "FACET" {
+		return limits[0]
+	}
+	return -1
+}
+
+// `scanTopLevel()` calls `f` with the offset of each byte of `s` which is
+// outside of any quotes or parentheses; `f` returns the offset of the last byte
+// it consumed, so it can skip ahead.
+func scanTopLevel(s string, f func(i int) int) {
+	var depth int
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++ // skip the escaped character
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0:
+			i = f(i)
+		}
+	}
+}
+
+// `findClauses()` returns the (supported and unsupported) clause keywords in
+// `s`, in order. Keywords inside quotes or parentheses (e.g., the WHERE of a
+// `filter()`) don't count.
+func findClauses(s string) []clause {
+	var clauses []clause
+	scanTopLevel(s, func(i int) int {
+		if !isWordByte(s[i]) || (i > 0 && isWordByte(s[i-1])) {
+			return i
+		}
+		end := i
+		for end < len(s) && isWordByte(s[end]) {
+			end++
+		}
+		word := strings.ToUpper(s[i:end])
+		if clauseKeywords[word] || unsupportedKeywords[word] {
+			clauses = append(clauses, clause{keyword: word, start: i, end: end})
+		}
+		return end - 1
+	})
+	return clauses
+}
+
+// `splitTopLevel()` splits `s` on the commas which aren't inside quotes or
+// parentheses.
+func splitTopLevel(s string) []string {
+	var parts []string
+	start := 0
+	scanTopLevel(s, func(i int) int {
+		if s[i] == ',' {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+		return i
+	})
+	return append(parts, s[start:])
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// `unquoteString()` reverses `quoteString()`; strings which aren't
+// single-quoted are returned as-is.
+func unquoteString(s string) string {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
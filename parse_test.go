@@ -0,0 +1,204 @@
+package nrql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQueryRoundTrip(t *testing.T) {
+	for _, q := range []Query{
+		{Table: "Transaction", Limit: -1},
+		{
+			Columns: []string{"count(*)", "average(duration)"},
+			Table:   "Transaction",
+			Limit:   10,
+		},
+		{
+			Columns: []string{
+				"filter(count(*), WHERE error IS true) AS 'Errors, All'",
+				"percentile(duration, 50, 95)",
+			},
+			Table: "Transaction, PageView",
+			Limit: -1,
+		},
+		{
+			Table: "Transaction",
+			Where: "name = 'O\\'Brien' AND (code = 500 OR path LIKE " +
+				"'%LIMIT 10%')",
+			Since: "3 days ago",
+			Until: "1 day ago",
+			Limit: -1,
+		},
+		{
+			Table: "Transaction",
+			Since: "1700000000000",
+			Until: "1700086400000",
+			Limit: -1,
+		},
+		{
+			Table: "Transaction",
+			Since: "2024-01-01 00:00:00",
+			Until: "2024-01-02 00:00:00",
+			Limit: -1,
+		},
+		{
+			Columns:    []string{"count(*)"},
+			Table:      "Transaction",
+			Since:      "yesterday",
+			Until:      "today",
+			Facet:      "appName, host",
+			FacetLimit: 20,
+			Limit:      100,
+			Offset:     200,
+		},
+		{Table: "Transaction", Since: "this week", LimitMax: true, Limit: -1},
+		{
+			Columns:     []string{"count(*)"},
+			Table:       "Transaction",
+			Since:       "1 DAY AGO",
+			Facet:       "appName",
+			Limit:       -1,
+			TimeSeries:  "30 minutes",
+			SlideBy:     "5 minutes",
+			Extrapolate: true,
+		},
+		{Table: "`My Events`", TimeSeries: "AUTO", Limit: 0},
+	} {
+		got, err := ParseQuery(q.String())
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Errorf("%s: wanted %#v; got %#v", q, q, got)
+		}
+	}
+}
+
+func TestParseQueryRoundTripRendering(t *testing.T) {
+	// These don't come back field for field (see `ParseQuery()`), but they
+	// render the same NRQL
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, q := range []Query{
+		{
+			Table:       "Transaction",
+			WhereClause: And(Eq("name", "it's"), Not(Eq("code", 500))),
+			Limit:       -1,
+		},
+		{
+			Table:       "Transaction",
+			Where:       "appName = 'checkout'",
+			WhereClause: Or(Eq("host", "a"), Eq("host", "b")),
+			Limit:       -1,
+		},
+		{
+			Table:     "Transaction",
+			SinceTime: since,
+			UntilTime: since.Add(time.Hour),
+			Limit:     -1,
+		},
+		{Table: "Transaction", Facet: "host", FacetLimit: 5, Limit: -1},
+	} {
+		got, err := ParseQuery(q.String())
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+		} else if got.String() != q.String() {
+			t.Errorf("wanted %s; got %s", q, got)
+		}
+	}
+}
+
+func TestParseQueryInvalid(t *testing.T) {
+	for _, nrql := range []string{
+		"",
+		"FROM Transaction",
+		"Transaction SELECT *",
+		"SELECT * FROM Transaction WHERE",
+		"SELECT * FROM Transaction WHERE a = 1 WHERE b = 2",
+		"SELECT * FROM Transaction LIMIT ten",
+		"SELECT * FROM Transaction LIMIT -1",
+		"SELECT * FROM Transaction OFFSET -1",
+		"SELECT a,, b FROM Transaction",
+		"SELECT * FROM Transaction SLIDE 5 minutes",
+		"SELECT * FROM Transaction EXTRAPOLATE please",
+		"SELECT * FROM Transaction SINCE 1 day ago COMPARE WITH 1 week ago",
+		"SELECT * FROM Transaction SINCE 1 day ago WITH TIMEZONE 'UTC'",
+		"SELECT * FROM Transaction ORDER BY duration",
+		"SELECT * FROM Transaction SINCE 1 day ago AS OF 2 days ago",
+		"SELECT * FROM Transaction SINCE '2024-01-01' AS OF yesterday",
+		"SELECT * FROM Transaction SINCE 3 fortnights ago",
+		"SELECT * FROM Transaction SINCE '2024-01-01",
+		"SELECT * FROM Transaction UNTIL 'a' OR 'b'",
+		"SELECT * FROM Transaction UNTIL next week",
+		"SELECT * FROM T SHOW EVENT TYPES",
+		"SELECT * FROM Transaction, , PageView",
+		"SELECT * FROM Transaction SLIDE BY 5 minutes",
+	} {
+		if q, err := ParseQuery(nrql); err == nil {
+			t.Errorf("%q: wanted an error; got %#v", nrql, q)
+		}
+	}
+}
+
+func TestParseQueryFacetLimit(t *testing.T) {
+	for _, c := range []struct {
+		nrql              string
+		facetLimit, limit int
+	}{
+		{"SELECT * FROM T FACET host LIMIT 100 LIMIT 5000", 100, 5000},
+		{"select * from T facet host limit 100 limit 5000", 100, 5000},
+		{"SELECT * FROM T FACET host LIMIT 100", 0, 100},
+		{"SELECT * FROM T LIMIT 10 FACET host", 0, 10},
+	} {
+		q, err := ParseQuery(c.nrql)
+		if err != nil {
+			t.Errorf("%s: %v", c.nrql, err)
+			continue
+		}
+		if q.Facet != "host" {
+			t.Errorf("%s: wanted FACET host; got %q", c.nrql, q.Facet)
+		}
+		if q.FacetLimit != c.facetLimit || q.Limit != c.limit {
+			t.Errorf(
+				"%s: wanted FACET LIMIT %d and LIMIT %d; got %d and %d",
+				c.nrql,
+				c.facetLimit,
+				c.limit,
+				q.FacetLimit,
+				q.Limit,
+			)
+		}
+	}
+}
+
+func TestParseQueryFacetLimitRoundTrip(t *testing.T) {
+	q := Query{
+		Columns:    []string{"count(*)"},
+		Table:      "Transaction",
+		Facet:      "host",
+		FacetLimit: 100,
+		Limit:      5000,
+	}
+	got, err := ParseQuery(q.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != q.String() {
+		t.Errorf("wanted %q; got %q", q.String(), got.String())
+	}
+}
+
+func TestParseQueryFacetLimitInvalid(t *testing.T) {
+	for _, nrql := range []string{
+		"SELECT * FROM T FACET host LIMIT 0 LIMIT 10",
+		"SELECT * FROM T FACET host LIMIT many LIMIT 10",
+		"SELECT * FROM T FACET host LIMIT MAX LIMIT 10",
+		// Two LIMITs, but neither directly follows FACET
+		"SELECT * FROM T LIMIT 5000 FACET host LIMIT 100",
+	} {
+		if _, err := ParseQuery(nrql); err == nil {
+			t.Errorf("%s: wanted an error", nrql)
+		}
+	}
+}
@@ -4,14 +4,51 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
 )
 
 // This is an abstraction over all of the varieties of payloads the New Relic
 // API might send down.
 type Payload interface {
 	Columns() []string
-	Rows() [][]interface{}
+	Rows() ([][]interface{}, error)
+
+	// Which variety of payload this is, for callers which treat some
+	// specially (e.g., the facet column of a faceted payload)
+	Kind() PayloadKind
+}
+
+// PayloadKind identifies which variety of payload a query produced.
+type PayloadKind int
+
+const (
+	PayloadKindUnknown PayloadKind = iota
+	PayloadKindBasic
+	PayloadKindAggregation
+	PayloadKindFacet
+	PayloadKindFunnel
+	PayloadKindHistogram
+	PayloadKindTimeSeries
+)
+
+var payloadKindNames = map[PayloadKind]string{
+	PayloadKindUnknown:     "unknown",
+	PayloadKindBasic:       "basic",
+	PayloadKindAggregation: "aggregation",
+	PayloadKindFacet:       "facet",
+	PayloadKindFunnel:      "funnel",
+	PayloadKindHistogram:   "histogram",
+	PayloadKindTimeSeries:  "timeseries",
+}
+
+func (k PayloadKind) String() string {
+	if name, ok := payloadKindNames[k]; ok {
+		return name
+	}
+	return payloadKindNames[PayloadKindUnknown]
 }
 
 type StaticColumn struct {
@@ -22,6 +59,7 @@ type StaticColumn struct {
 // static columns. Given a table with columns {a, b, c} and static columns
 // {d, e} with values {4, 5} respectively, the resultant columns will be {a, b,
 // c, d, e} and the last two columns will be entirely 4s and 5s respectively.
+// Its `Kind()` is that of the wrapped payload.
 type StaticColumnsPayload struct {
 	Payload
 	StaticColumns []StaticColumn
@@ -36,14 +74,42 @@ func (p StaticColumnsPayload) Columns() []string {
 	return append(columns, staticColumnHeaders...)
 }
 
-func (p StaticColumnsPayload) Rows() [][]interface{} {
-	rows := p.Payload.Rows()
-	for _, column := range p.StaticColumns {
-		for i, row := range rows {
-			rows[i] = append(row, column.Value)
+// `NewStaticColumnsPayload()` wraps `p`, suffixing it with `columns`.
+func NewStaticColumnsPayload(
+	p Payload,
+	columns ...StaticColumn,
+) StaticColumnsPayload {
+	return StaticColumnsPayload{Payload: p, StaticColumns: columns}
+}
+
+// `Rows()` returns new rows rather than appending to the wrapped payload's, so
+// it may be called any number of times. Rows which are shorter than the
+// wrapped payload's columns are padded with nulls so the static values line up
+// with their headers; rows which are longer are an error, since there's no
+// telling which cells the static values belong after.
+func (p StaticColumnsPayload) Rows() ([][]interface{}, error) {
+	rows, err := p.Payload.Rows()
+	if err != nil {
+		return nil, err
+	}
+	width := len(p.Payload.Columns())
+	out := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		if len(row) > width {
+			return nil, fmt.Errorf(
+				"Row %d has %d cells but there are only %d columns",
+				i,
+				len(row),
+				width,
+			)
+		}
+		out[i] = make([]interface{}, width, width+len(p.StaticColumns))
+		copy(out[i], row)
+		for _, column := range p.StaticColumns {
+			out[i] = append(out[i], column.Value)
 		}
 	}
-	return rows
+	return out, nil
 }
 
 // This represents the basic (no-aggregations, no-facets) payload type.
@@ -79,8 +145,9 @@ func (p *PayloadBasic) Columns() []string {
 	}
 
 	// If this is nil, we should look to the first row for our columns. If
-	// there are no rows, we're up a creek...
-	if len(p.Results[0].Events) < 0 {
+	// there are no rows (the query matched nothing), there are no columns
+	// either.
+	if len(p.Results[0].Events) == 0 {
 		return nil
 	}
 
@@ -93,7 +160,7 @@ func (p *PayloadBasic) Columns() []string {
 	return p.cols
 }
 
-func (p PayloadBasic) Rows() [][]interface{} {
+func (p PayloadBasic) Rows() ([][]interface{}, error) {
 	var rows [][]interface{}
 	columns := p.Columns()
 	for _, event := range p.Results[0].Events {
@@ -103,71 +170,242 @@ func (p PayloadBasic) Rows() [][]interface{} {
 		}
 		rows = append(rows, row)
 	}
-	return rows
+	return rows, nil
 }
 
-type PayloadAggregation struct {
-	Results  []map[string]interface{} `json:"results"`
-	Metadata struct {
-		Contents []struct {
-			Function string `json:"function"`
+func (p PayloadBasic) Kind() PayloadKind {
+	return PayloadKindBasic
+}
+
+// AggregationContent describes one aggregation of a query (e.g.,
+// `average(duration)`), as found in the metadata of aggregation and facet
+// payloads.
+type AggregationContent struct {
+	Function string `json:"function"`
+
+	// Only populated if Function == "alias"
+	Alias string `json:"alias"`
+
+	// Only populated if Function == "alias"
+	Contents struct {
+		Function   string    `json:"function"`
+		Attribute  string    `json:"attribute"`
+		Thresholds []float64 `json:"thresholds"`
+	}
+
+	// Empty if Function == "alias"
+	Attribute string `json:"attribute"`
+
+	// The percentiles of a `percentile()` aggregation (e.g., 50, 95 and 99);
+	// empty if Function == "alias"
+	Thresholds []float64 `json:"thresholds"`
+}
 
-			// Only populated if Function == "alias"
-			Alias string `json:"alias"`
+// `Column()` returns the aggregation's column header: its alias, if it has
+// one, or else the function and its attribute (e.g., "average(duration)"), so
+// that two aggregations with the same function don't share a header.
+func (c AggregationContent) Column() string {
+	function, attribute := c.Function, c.Attribute
+	if function == "alias" {
+		if c.Alias != "" {
+			return c.Alias
+		}
+		function, attribute = c.Contents.Function, c.Contents.Attribute
+	}
+	if attribute == "" {
+		return function
+	}
+	return function + "(" + attribute + ")"
+}
 
-			// Only populated if Function == "alias"
-			Contents struct {
-				Function  string `json:"function"`
-				Attribute string `json:"attribute"`
+// `Columns()` returns the aggregation's column headers. That's just
+// `Column()`, except for a `percentile()` of more than one percentile, which
+// gets a column per percentile (e.g., "percentile(duration).95").
+func (c AggregationContent) Columns() []string {
+	thresholds := c.thresholds()
+	if len(thresholds) < 2 {
+		return []string{c.Column()}
+	}
+	columns := make([]string, len(thresholds))
+	for i, threshold := range thresholds {
+		columns[i] = c.Column() + "." + thresholdKey(threshold)
+	}
+	return columns
+}
+
+func (c AggregationContent) thresholds() []float64 {
+	if c.Function == "alias" {
+		return c.Contents.Thresholds
+	}
+	return c.Thresholds
+}
+
+// `thresholdKey()` renders a percentile as New Relic keys its value, e.g.
+// "95" or "99.9".
+func thresholdKey(threshold float64) string {
+	return strconv.FormatFloat(threshold, 'f', -1, 64)
+}
+
+// `values()` returns the values of the aggregation's columns from its cell.
+// A `percentile()` cell maps each percentile to its value, either directly or
+// under a single key (e.g., "percentiles"); a percentile missing from it is
+// nil.
+func (c AggregationContent) values(
+	cell map[string]interface{},
+) ([]interface{}, error) {
+	thresholds := c.thresholds()
+	if len(thresholds) < 2 {
+		value, err := parseCell(cell)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := value.(map[string]interface{}); ok && len(thresholds) == 1 {
+			if v, ok := m[thresholdKey(thresholds[0])]; ok {
+				value = v
 			}
+		}
+		return []interface{}{value}, nil
+	}
 
-			// Empty if Function == "alias"
-			Attribute string `json:"attribute"`
-		} `json:"contents"`
+	percentiles := cell
+	if value, err := parseCell(cell); err == nil {
+		if m, ok := value.(map[string]interface{}); ok {
+			percentiles = m
+		}
+	}
+	values := make([]interface{}, len(thresholds))
+	for i, threshold := range thresholds {
+		values[i] = percentiles[thresholdKey(threshold)]
+	}
+	return values, nil
+}
+
+// `aggregationColumns()` returns the column headers of `contents`, in order.
+func aggregationColumns(contents []AggregationContent) []string {
+	columns := make([]string, 0, len(contents))
+	for _, content := range contents {
+		columns = append(columns, content.Columns()...)
+	}
+	return columns
+}
+
+type PayloadAggregation struct {
+	Results  []map[string]interface{} `json:"results"`
+	Metadata struct {
+		Contents []AggregationContent `json:"contents"`
 	} `json:"metadata"`
 }
 
 func (p PayloadAggregation) Columns() []string {
-	columns := make([]string, len(p.Metadata.Contents))
-	for i, content := range p.Metadata.Contents {
-		columns[i] = content.Function
-		if columns[i] == "alias" {
-			columns[i] = content.Alias
+	return uniqueColumns(aggregationColumns(p.Metadata.Contents))
+}
+
+// `uniqueColumns()` renames the repeats of any column header in `columns`
+// (e.g., from `SELECT count(*), count(*)`) in place, by suffixing them with
+// "_2", "_3", etc., so that consumers which key by header don't lose any. The
+// first occurrence keeps its name, and no suffixed name clashes with another
+// header.
+func uniqueColumns(columns []string) []string {
+	taken := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		taken[column] = true
+	}
+	seen := make(map[string]bool, len(columns))
+	for i, column := range columns {
+		if !seen[column] {
+			seen[column] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			if name := column + "_" + strconv.Itoa(n); !taken[name] {
+				taken[name] = true
+				columns[i] = name
+				break
+			}
 		}
 	}
 	return columns
 }
 
-// A cell is a single-element mapping between a string (usually a function
-// name) and a scalar value. I don't understand why NewRelic chose a map to
-// represent a single element (perhaps there are edge cases where there might
-// be more than one element, but I can't imagine what they might be). If there
-func parseCell(cell map[string]interface{}) interface{} {
+// A cell is usually a single-element mapping between a string (usually a
+// function name) and a scalar value. The exception is `percentile()` with
+// more than one percentile, whose cell holds them all; that's handled by
+// `AggregationContent.values()`. Otherwise, if there isn't exactly one
+// element, an error is returned.
+func parseCell(cell map[string]interface{}) (interface{}, error) {
 	if len(cell) != 1 {
-		// This shouldn't happen; for debugging purposes, we'll just fail
-		// loudly if it does
-		log.Fatal("WARNING: multiple key/value pairs found in cell:", cell)
+		return nil, fmt.Errorf(
+			"Wanted 1 key/value pair in cell; found %d: %v",
+			len(cell),
+			cell,
+		)
 	}
+	var value interface{}
 	for _, v := range cell {
-		return v
+		value = v
 	}
-	panic("Unreachable")
+	return value, nil
 }
 
-func parseRow(row []map[string]interface{}) []interface{} {
-	out := make([]interface{}, len(row))
+// `parseRow()` returns the values of `row`'s cells, which line up with
+// `contents`.
+func parseRow(
+	row []map[string]interface{},
+	contents []AggregationContent,
+) ([]interface{}, error) {
+	out := make([]interface{}, 0, len(row))
 	for i, cell := range row {
-		out[i] = parseCell(cell)
+		var content AggregationContent
+		if i < len(contents) {
+			content = contents[i]
+		}
+		values, err := content.values(cell)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, values...)
 	}
-	return out
+	return out, nil
 }
 
-// This always returns one row
-func (p PayloadAggregation) Rows() [][]interface{} {
-	return [][]interface{}{parseRow(p.Results)}
+// This returns one row, or none if there are no results at all (as for some
+// aggregations over empty time ranges).
+func (p PayloadAggregation) Rows() ([][]interface{}, error) {
+	if len(p.Results) == 0 {
+		return [][]interface{}{}, nil
+	}
+	row, err := parseRow(p.Results, p.Metadata.Contents)
+	if err != nil {
+		return nil, err
+	}
+	return [][]interface{}{row}, nil
+}
+
+func (p PayloadAggregation) Kind() PayloadKind {
+	return PayloadKindAggregation
 }
 
+// The default labels of the rows added by `PayloadFacet.IncludeTotal` and
+// `PayloadFacet.IncludeUnknown` respectively
+const (
+	DefaultTotalLabel   = "<total>"
+	DefaultUnknownLabel = "(unknown)"
+)
+
 type PayloadFacet struct {
+	// If set, `Rows()` appends a final row containing the overall total
+	// (`TotalResult`) across all facets, labeled `TotalLabel` (or
+	// `DefaultTotalLabel`, if empty).
+	IncludeTotal bool   `json:"-"`
+	TotalLabel   string `json:"-"`
+
+	// If set, `Rows()` appends a row (before the total, if any) for the
+	// events which lack the facet attribute altogether (`UnknownGroup`),
+	// labeled `UnknownLabel` (or `DefaultUnknownLabel`, if empty). Without
+	// this, those events are silently missing from the per-facet rows.
+	IncludeUnknown bool   `json:"-"`
+	UnknownLabel   string `json:"-"`
+
 	Facets []struct {
 		Name    string                   `json:"name"`
 		Results []map[string]interface{} `json:"results"`
@@ -181,104 +419,508 @@ type PayloadFacet struct {
 	Metadata struct {
 		Facet    string `json:"facet"`
 		Contents struct {
-			Contents []struct {
-				Function string `json:"function"`
+			Contents []AggregationContent `json:"contents"`
+		} `json:"contents"`
+	} `json:"metadata"`
+}
 
-				// Only populated if Function == "alias"
-				Alias string `json:"alias"`
+func (p PayloadFacet) Columns() []string {
+	return uniqueColumns(append(
+		[]string{p.Metadata.Facet},
+		aggregationColumns(p.Metadata.Contents.Contents)...,
+	))
+}
 
-				// Only populated if Function == "alias"
-				Contents struct {
-					Function  string `json:"function"`
-					Attribute string `json:"attribute"`
-				}
+func labelOr(label, fallback string) string {
+	if label == "" {
+		return fallback
+	}
+	return label
+}
+
+// Each row is the facet name followed by the values of the facet's cells,
+// which line up with the aggregation columns.
+func (p PayloadFacet) facetRow(
+	name string,
+	cells []map[string]interface{},
+) ([]interface{}, error) {
+	values, err := parseRow(cells, p.Metadata.Contents.Contents)
+	if err != nil {
+		return nil, fmt.Errorf("Facet '%s': %v", name, err)
+	}
+	return append([]interface{}{name}, values...), nil
+}
+
+func (p PayloadFacet) Rows() ([][]interface{}, error) {
+	rows := make([][]interface{}, 0, len(p.Facets)+2)
+	for _, facet := range p.Facets {
+		row, err := p.facetRow(facet.Name, facet.Results)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+
+	// Not every query gets an unknown group or a total from New Relic;
+	// there's no row to add if they're missing.
+	if p.IncludeUnknown && len(p.UnknownGroup.Results) > 0 {
+		row, err := p.facetRow(
+			labelOr(p.UnknownLabel, DefaultUnknownLabel),
+			p.UnknownGroup.Results,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	if p.IncludeTotal && len(p.TotalResult.Results) > 0 {
+		row, err := p.facetRow(
+			labelOr(p.TotalLabel, DefaultTotalLabel),
+			p.TotalResult.Results,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
 
-				// Empty if Function == "alias"
-				Attribute string `json:"attribute"`
-			} `json:"contents"`
+func (p PayloadFacet) Kind() PayloadKind {
+	return PayloadKindFacet
+}
+
+// This represents the payload for `SELECT funnel(...)` queries. The results
+// look like an aggregation's, but the single cell holds a list of step counts
+// rather than a scalar, and the step names live in the metadata.
+type PayloadFunnel struct {
+	Results []struct {
+		Steps []interface{} `json:"steps"`
+	} `json:"results"`
+	Metadata struct {
+		Contents []struct {
+			Function  string   `json:"function"`
+			Attribute string   `json:"attribute"`
+			Steps     []string `json:"steps"`
 		} `json:"contents"`
 	} `json:"metadata"`
 }
 
-func (p PayloadFacet) Columns() []string {
-	columns := make([]string, len(p.Metadata.Contents.Contents)+1)
-	columns[0] = p.Metadata.Facet
-	for i, content := range p.Metadata.Contents.Contents {
-		columns[i+1] = content.Function
-		if content.Function == "alias" {
-			columns[i+1] = content.Alias
+// `isFunnel()` returns true if the metadata describes a funnel() query
+func (p PayloadFunnel) isFunnel() bool {
+	return len(p.Metadata.Contents) == 1 &&
+		p.Metadata.Contents[0].Function == "funnel"
+}
+
+func (p PayloadFunnel) steps() []interface{} {
+	if len(p.Results) < 1 {
+		return nil
+	}
+	return p.Results[0].Steps
+}
+
+// There is one column per step. The step names come from the metadata; if
+// New Relic doesn't send them (or sends too few), they're numbered instead.
+func (p PayloadFunnel) Columns() []string {
+	columns := make([]string, len(p.steps()))
+	var names []string
+	if p.isFunnel() {
+		names = p.Metadata.Contents[0].Steps
+	}
+	for i := range columns {
+		if i < len(names) && names[i] != "" {
+			columns[i] = names[i]
+		} else {
+			columns[i] = fmt.Sprintf("step %d", i+1)
 		}
 	}
 	return columns
 }
 
-func (p PayloadFacet) Rows() [][]interface{} {
-	rows := make([][]interface{}, len(p.Facets))
-	for i, facet := range p.Facets {
-		row := make([]interface{}, len(facet.Results)+1)
-		row[0] = facet.Name
-		for j, cell := range facet.Results {
-			row[j+1] = parseCell(cell)
+// This always returns one row: the count of each step
+func (p PayloadFunnel) Rows() ([][]interface{}, error) {
+	return [][]interface{}{p.steps()}, nil
+}
+
+func (p PayloadFunnel) Kind() PayloadKind {
+	return PayloadKindFunnel
+}
+
+// This represents the payload for `SELECT histogram(...)` queries. The single
+// result holds the count of each bucket, and the metadata describes where the
+// buckets start and how wide they are.
+type PayloadHistogram struct {
+	Results []struct {
+		Histogram []interface{} `json:"histogram"`
+	} `json:"results"`
+	Metadata struct {
+		Contents []struct {
+			Function   string  `json:"function"`
+			Attribute  string  `json:"attribute"`
+			BucketSize float64 `json:"bucketSize"`
+			MinValue   float64 `json:"minValue"`
+			MaxValue   float64 `json:"maxValue"`
+		} `json:"contents"`
+	} `json:"metadata"`
+}
+
+// `isHistogram()` returns true if the metadata describes a histogram() query
+func (p PayloadHistogram) isHistogram() bool {
+	return len(p.Metadata.Contents) == 1 &&
+		p.Metadata.Contents[0].Function == "histogram"
+}
+
+// The first column is each bucket's lower bound; the second is its count.
+func (p PayloadHistogram) Columns() []string {
+	return []string{"bucket", "count"}
+}
+
+// This returns one row per bucket; an empty histogram yields no rows.
+func (p PayloadHistogram) Rows() ([][]interface{}, error) {
+	if len(p.Results) < 1 || !p.isHistogram() {
+		return [][]interface{}{}, nil
+	}
+	content := p.Metadata.Contents[0]
+	counts := p.Results[0].Histogram
+	rows := make([][]interface{}, len(counts))
+	for i, count := range counts {
+		rows[i] = []interface{}{
+			content.MinValue + float64(i)*content.BucketSize,
+			count,
 		}
-		rows[i] = row
 	}
-	return rows
+	return rows, nil
 }
 
-// This function tries to guess the type of New Relic payload and decode it
-// accordingly
-func unmarshalPayload(data []byte) (Payload, error) {
-	// Allocate 3 mutually exclusive payload instances; exactly one of these
-	// should match the JSON payload. This is a hack, but I can't think of a
-	// better way to cope with NewRelic's wonky API.
-	var basic PayloadBasic
-	var aggregation PayloadAggregation
-	var facet PayloadFacet
-
-	var basicErr error
-	if basicErr = json.Unmarshal(data, &basic); basicErr == nil {
-		if basic.Results[0].Events != nil {
-			return &basic, nil
+func (p PayloadHistogram) Kind() PayloadKind {
+	return PayloadKindHistogram
+}
+
+// The column headers of each bucket's bounds in `PayloadTimeSeries`, in epoch
+// seconds
+const (
+	TimeSeriesBeginColumn = "beginTimeSeconds"
+	TimeSeriesEndColumn   = "endTimeSeconds"
+)
+
+// TimeSeriesBucket holds the results of one of a TIMESERIES query's buckets.
+// The results line up with the query's aggregations, as in an aggregation
+// payload.
+type TimeSeriesBucket struct {
+	BeginTimeSeconds float64                  `json:"beginTimeSeconds"`
+	EndTimeSeconds   float64                  `json:"endTimeSeconds"`
+	Results          []map[string]interface{} `json:"results"`
+}
+
+// This represents the payload for TIMESERIES queries. Without a FACET, the
+// buckets are listed under `timeSeries`; with one, each facet lists its own.
+// The aggregations are described under the metadata's `timeSeries` (or, when
+// faceted, under its `contents`' `timeSeries`).
+type PayloadTimeSeries struct {
+	TimeSeries []TimeSeriesBucket `json:"timeSeries"`
+	Facets     []struct {
+		Name       string             `json:"name"`
+		TimeSeries []TimeSeriesBucket `json:"timeSeries"`
+	} `json:"facets"`
+	Metadata struct {
+		Facet      string `json:"facet"`
+		TimeSeries struct {
+			Contents []AggregationContent `json:"contents"`
+		} `json:"timeSeries"`
+		// When faceted, an object wrapping the aggregations; it's decoded by
+		// `contents()`, since its shape varies with the query
+		Contents json.RawMessage `json:"contents"`
+	} `json:"metadata"`
+}
+
+// `faceted()` returns true if the query had a FACET clause.
+func (p PayloadTimeSeries) faceted() bool {
+	return p.Metadata.Facet != "" || len(p.Facets) > 0
+}
+
+func (p PayloadTimeSeries) contents() []AggregationContent {
+	if contents := p.Metadata.TimeSeries.Contents; contents != nil {
+		return contents
+	}
+	var wrapper struct {
+		TimeSeries struct {
+			Contents []AggregationContent `json:"contents"`
+		} `json:"timeSeries"`
+	}
+	if json.Unmarshal(p.Metadata.Contents, &wrapper) != nil {
+		return nil
+	}
+	return wrapper.TimeSeries.Contents
+}
+
+// The columns are the facet (if any), the bounds of the bucket, and then the
+// aggregations.
+func (p PayloadTimeSeries) Columns() []string {
+	var columns []string
+	if p.faceted() {
+		columns = append(columns, p.Metadata.Facet)
+	}
+	columns = append(columns, TimeSeriesBeginColumn, TimeSeriesEndColumn)
+	return uniqueColumns(
+		append(columns, aggregationColumns(p.contents())...),
+	)
+}
+
+// This returns one row per bucket, or, when faceted, one row per bucket of
+// each facet in turn.
+func (p PayloadTimeSeries) Rows() ([][]interface{}, error) {
+	contents := p.contents()
+	bucketRows := func(
+		prefix []interface{},
+		buckets []TimeSeriesBucket,
+	) ([][]interface{}, error) {
+		rows := make([][]interface{}, len(buckets))
+		for i, bucket := range buckets {
+			values, err := parseRow(bucket.Results, contents)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Bucket %v-%v: %v",
+					bucket.BeginTimeSeconds,
+					bucket.EndTimeSeconds,
+					err,
+				)
+			}
+			row := make([]interface{}, 0, len(prefix)+2+len(values))
+			row = append(row, prefix...)
+			row = append(row, bucket.BeginTimeSeconds, bucket.EndTimeSeconds)
+			rows[i] = append(row, values...)
 		}
-		basicErr = fmt.Errorf("missing 'results[0].events' field")
+		return rows, nil
 	}
 
-	var aggregationErr error
-	if aggregationErr = json.Unmarshal(data, &aggregation); aggregationErr == nil {
-		if aggregation.Results != nil {
-			return aggregation, nil
+	if !p.faceted() {
+		return bucketRows(nil, p.TimeSeries)
+	}
+	rows := [][]interface{}{}
+	for _, facet := range p.Facets {
+		facetRows, err := bucketRows(
+			[]interface{}{facet.Name},
+			facet.TimeSeries,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Facet '%s': %v", facet.Name, err)
 		}
-		aggregationErr = fmt.Errorf("missing 'results' field")
+		rows = append(rows, facetRows...)
 	}
+	return rows, nil
+}
+
+func (p PayloadTimeSeries) Kind() PayloadKind {
+	return PayloadKindTimeSeries
+}
 
-	var facetErr error
-	if facetErr = json.Unmarshal(data, &facet); facetErr == nil {
-		return facet, nil
+// `DecodePayload()` reads a payload, as sent by New Relic's query API, from
+// `r`. The JSON value is read into memory once (its variety can't be known
+// until it's all been read); anything after it is left unread. The payload's
+// rows are decoded up front; see `DecodePayloadLazily()` to decode events as
+// they're iterated instead.
+func DecodePayload(r io.Reader) (Payload, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Decoding payload: %v", err)
 	}
+	return guessPayload(data, false)
+}
 
-	// pretty print payload data for error message
-	var buf bytes.Buffer
-	if err := json.Indent(&buf, data, "", "    "); err != nil {
-		panic(err)
-	}
-
-	// pretty print error data for error message
-	errorJSON, err := json.MarshalIndent(
-		map[string]string{
-			"basic":       basicErr.Error(),
-			"aggregation": aggregationErr.Error(),
-			"facet":       facetErr.Error(),
-		},
-		"",
-		"    ",
-	)
+func unmarshalPayload(data []byte) (Payload, error) {
+	return DecodePayload(bytes.NewReader(data))
+}
+
+// `PayloadFromJSON()` decodes a payload from `data`, a response body from New
+// Relic's query API (e.g., one saved by `ExecRawResponse()`), without making a
+// request. It accepts anything the clients do.
+func PayloadFromJSON(data []byte) (Payload, error) {
+	return unmarshalPayload(data)
+}
+
+// `PayloadFromFile()` is like `PayloadFromJSON()`, for the response saved at
+// `path`, e.g. to re-format an archived extract offline.
+func PayloadFromFile(path string) (Payload, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	p, err := PayloadFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing payload file %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// payloadProbe holds just enough of a payload to tell which variety it is;
+// the rest is left undecoded.
+type payloadProbe struct {
+	// Set instead of the rest if the query failed (e.g., a NRQL syntax
+	// error), despite the HTTP 200
+	Error json.RawMessage `json:"error"`
+
+	Results    json.RawMessage `json:"results"`
+	Facets     json.RawMessage `json:"facets"`
+	TimeSeries json.RawMessage `json:"timeSeries"`
+	Metadata   struct {
+		// A list of functions, except in facet payloads (where it's an
+		// object wrapping the list)
+		Contents json.RawMessage `json:"contents"`
+	} `json:"metadata"`
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// `function()` returns the name of the query's function if the metadata
+// lists exactly one, like `funnel()` or `histogram()` queries.
+func (p payloadProbe) function() string {
+	var contents []struct {
+		Function string `json:"function"`
+	}
+	if json.Unmarshal(p.Metadata.Contents, &contents) != nil ||
+		len(contents) != 1 {
+		return ""
+	}
+	return contents[0].Function
+}
 
+// `hasEvents()` returns true if the first result holds a list of events.
+func (p payloadProbe) hasEvents() bool {
+	var results []struct {
+		Events json.RawMessage `json:"events"`
+	}
+	return json.Unmarshal(p.Results, &results) == nil &&
+		len(results) > 0 &&
+		!isNull(results[0].Events)
+}
+
+// `isTimeSeries()` returns true if the probe came from a TIMESERIES query:
+// the buckets are at the top level or, when faceted, under each facet.
+func (p payloadProbe) isTimeSeries() bool {
+	if !isNull(p.TimeSeries) {
+		return true
+	}
+	var facets []struct {
+		TimeSeries json.RawMessage `json:"timeSeries"`
+	}
+	return json.Unmarshal(p.Facets, &facets) == nil &&
+		len(facets) > 0 &&
+		!isNull(facets[0].TimeSeries)
+}
+
+// `kind()` returns the variety of payload the probe came from, or
+// `PayloadKindUnknown`.
+func (p payloadProbe) kind() PayloadKind {
+	switch {
+	// Faceted time series must be checked before the facet payload, whose
+	// `facets` they share (with buckets in place of the results)
+	case p.isTimeSeries():
+		return PayloadKindTimeSeries
+	case !isNull(p.Facets):
+		return PayloadKindFacet
+	case p.hasEvents():
+		return PayloadKindBasic
+	// Funnels and histograms must be checked before the aggregation
+	// payload, whose shape they share (with the list of counts as a
+	// single cell)
+	case p.function() == "funnel":
+		return PayloadKindFunnel
+	case p.function() == "histogram":
+		return PayloadKindHistogram
+	case !isNull(p.Results):
+		return PayloadKindAggregation
+	case p.isEmpty():
+		return PayloadKindAggregation
+	}
+	return PayloadKindUnknown
+}
+
+// `isEmpty()` returns true if the probe came from a query which produced no
+// results section at all, as some aggregations over empty time ranges do:
+// the metadata still lists the query's functions, but there's nothing else.
+func (p payloadProbe) isEmpty() bool {
+	var contents []json.RawMessage
+	return isNull(p.Results) &&
+		json.Unmarshal(p.Metadata.Contents, &contents) == nil &&
+		contents != nil
+}
+
+// This function guesses the type of New Relic payload from its top-level
+// shape, and then decodes it as that type; if `lazy`, a basic payload is
+// decoded as a `*LazyPayloadBasic`.
+func guessPayload(data []byte, lazy bool) (Payload, error) {
+	var probe payloadProbe
+	err := json.Unmarshal(data, &probe)
+	if err == nil {
+		if message := errorFieldMessage(probe.Error); message != "" {
+			return nil, &APIError{
+				StatusCode: http.StatusOK,
+				Message:    message,
+				Body:       data,
+			}
+		}
+		if kind := probe.kind(); kind != PayloadKindUnknown {
+			var p Payload
+			var err error
+			if lazy && kind == PayloadKindBasic {
+				p, err = newLazyPayloadBasic(data)
+			} else {
+				p, err = decodePayloadAs(kind, data)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Decoding %s payload: %v", kind, err)
+			}
+			return p, nil
+		}
+		err = fmt.Errorf(
+			"no 'facets', 'timeSeries', 'results[0].events', or " +
+				"'results' field, and no 'funnel' or 'histogram' function " +
+				"in metadata",
+		)
+	}
+
+	// pretty print payload data for error message; if it isn't even valid
+	// JSON, the error above will say so and we'll print it as-is
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "    "); err != nil {
+		buf.Reset()
+		buf.Write(data)
+	}
 	return nil, fmt.Errorf(
-		"Couldn't find a match for payload.\nErrors: %s\nData: %s",
-		errorJSON,
+		"Couldn't find a match for payload: %v\nData: %s",
+		err,
 		buf.String(),
 	)
 }
+
+func decodePayloadAs(kind PayloadKind, data []byte) (Payload, error) {
+	switch kind {
+	case PayloadKindBasic:
+		var basic PayloadBasic
+		err := json.Unmarshal(data, &basic)
+		return &basic, err
+	case PayloadKindFunnel:
+		var funnel PayloadFunnel
+		err := json.Unmarshal(data, &funnel)
+		return funnel, err
+	case PayloadKindHistogram:
+		var histogram PayloadHistogram
+		err := json.Unmarshal(data, &histogram)
+		return histogram, err
+	case PayloadKindAggregation:
+		var aggregation PayloadAggregation
+		err := json.Unmarshal(data, &aggregation)
+		return aggregation, err
+	case PayloadKindFacet:
+		var facet PayloadFacet
+		err := json.Unmarshal(data, &facet)
+		return facet, err
+	case PayloadKindTimeSeries:
+		var timeSeries PayloadTimeSeries
+		err := json.Unmarshal(data, &timeSeries)
+		return timeSeries, err
+	}
+	return nil, fmt.Errorf("Unknown payload kind: %s", kind)
+}
@@ -0,0 +1,230 @@
+package nrql
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// `loadFixture()` decodes the payload saved in testdata/`name`.
+func loadFixture(t *testing.T, name string) Payload {
+	t.Helper()
+	p, err := PayloadFromFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// `checkPayload()` fails the test unless `p` is of the `kind` with the
+// `columns` and `rows`.
+func checkPayload(
+	t *testing.T,
+	p Payload,
+	kind PayloadKind,
+	columns []string,
+	rows [][]interface{},
+) {
+	t.Helper()
+	if p.Kind() != kind {
+		t.Errorf("Kind(): wanted %s; got %s", kind, p.Kind())
+	}
+	if got := p.Columns(); !reflect.DeepEqual(got, columns) {
+		t.Errorf("Columns(): wanted %q; got %q", columns, got)
+	}
+	got, err := p.Rows()
+	if err != nil {
+		t.Fatalf("Rows(): %v", err)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("Rows(): wanted %v; got %v", rows, got)
+	}
+}
+
+func TestFunnelPayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "funnel.json"),
+		PayloadKindFunnel,
+		[]string{"home", "cart", "checkout"},
+		[][]interface{}{{1200.0, 430.0, 87.0}},
+	)
+}
+
+func TestHistogramPayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "histogram.json"),
+		PayloadKindHistogram,
+		[]string{"bucket", "count"},
+		[][]interface{}{
+			{0.0, 12.0},
+			{0.25, 40.0},
+			{0.5, 7.0},
+			{0.75, 1.0},
+		},
+	)
+}
+
+func TestEmptyHistogramPayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "histogram_empty.json"),
+		PayloadKindHistogram,
+		[]string{"bucket", "count"},
+		[][]interface{}{},
+	)
+}
+
+func TestStaticColumnsPayloadRowsTwice(t *testing.T) {
+	p := NewStaticColumnsPayload(
+		loadFixture(t, "aggregation.json"),
+		StaticColumn{Name: "env", Value: "prod"},
+		StaticColumn{Name: "region", Value: "us"},
+	)
+	want := [][]interface{}{{1523.0, 0.42, "prod", "us"}}
+	for i := 0; i < 2; i++ {
+		checkPayload(
+			t,
+			p,
+			PayloadKindAggregation,
+			[]string{"count(*)", "average(duration)", "env", "region"},
+			want,
+		)
+	}
+}
+
+// A payload of fixed rows, which needn't be rectangular
+type testTable struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func (t testTable) Columns() []string { return t.columns }
+
+func (t testTable) Rows() ([][]interface{}, error) { return t.rows, nil }
+
+func (t testTable) Kind() PayloadKind { return PayloadKindBasic }
+
+func TestTimeSeriesPayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "timeseries.json"),
+		PayloadKindTimeSeries,
+		[]string{
+			"beginTimeSeconds",
+			"endTimeSeconds",
+			"count(*)",
+			"average(duration)",
+		},
+		[][]interface{}{
+			{1791932400.0, 1791932700.0, 10.0, 0.5},
+			{1791932700.0, 1791933000.0, 4.0, nil},
+		},
+	)
+}
+
+func TestFacetedTimeSeriesPayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "timeseries_facet.json"),
+		PayloadKindTimeSeries,
+		[]string{
+			"httpResponseCode",
+			"beginTimeSeconds",
+			"endTimeSeconds",
+			"count(*)",
+		},
+		[][]interface{}{
+			{"200", 1791932400.0, 1791932700.0, 9.0},
+			{"200", 1791932700.0, 1791933000.0, 3.0},
+			{"500", 1791932400.0, 1791932700.0, 1.0},
+			{"500", 1791932700.0, 1791933000.0, 0.0},
+		},
+	)
+}
+
+func TestFacetPayloadAggregations(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "facet_aggregations.json"),
+		PayloadKindFacet,
+		[]string{"host", "count(*)", "average(duration)", "Slowest"},
+		[][]interface{}{
+			{"web-1", 1200.0, 0.31, 4.2},
+			{"web-2", 323.0, 0.83, 9.7},
+		},
+	)
+}
+
+func TestEmptyAggregationPayload(t *testing.T) {
+	p := loadFixture(t, "aggregation_empty.json")
+	checkPayload(
+		t,
+		p,
+		PayloadKindAggregation,
+		[]string{"count(*)", "average(duration)"},
+		[][]interface{}{},
+	)
+	want := "count(*),average(duration)\n"
+	if got := formatCSV(t, p, CSVOptions{}); got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+}
+
+func TestPercentilePayload(t *testing.T) {
+	checkPayload(
+		t,
+		loadFixture(t, "percentile.json"),
+		PayloadKindAggregation,
+		[]string{
+			"percentile(duration).50",
+			"percentile(duration).95",
+			"percentile(duration).99",
+			"percentile(databaseDuration)",
+		},
+		[][]interface{}{{0.12, 0.87, 2.5, 6.1}},
+	)
+}
+
+func TestFacetPercentilePayload(t *testing.T) {
+	// A percentile missing from a facet's cell is null
+	checkPayload(
+		t,
+		loadFixture(t, "percentile_facet.json"),
+		PayloadKindFacet,
+		[]string{"appName", "p.50", "p.95"},
+		[][]interface{}{
+			{"checkout", 0.2, 1.4},
+			{"search", 0.05, nil},
+		},
+	)
+}
+
+func TestAggregationPayloadRepeatedColumns(t *testing.T) {
+	// The repeated count(*) skips the name another column already has
+	checkPayload(
+		t,
+		loadFixture(t, "aggregation_repeated.json"),
+		PayloadKindAggregation,
+		[]string{"count(*)", "count(*)_3", "count(*)_2"},
+		[][]interface{}{{1523.0, 1523.0, 0.42}},
+	)
+}
+
+func TestUniqueColumns(t *testing.T) {
+	for _, c := range []struct {
+		in, want []string
+	}{
+		{nil, nil},
+		{[]string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "a", "a"}, []string{"a", "a_2", "a_3"}},
+		{[]string{"a", "a", "a_2"}, []string{"a", "a_3", "a_2"}},
+		{[]string{"a", "b", "a", "b"}, []string{"a", "b", "a_2", "b_2"}},
+	} {
+		in := append([]string(nil), c.in...)
+		if got := uniqueColumns(in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: wanted %q; got %q", c.in, c.want, got)
+		}
+	}
+}
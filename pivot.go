@@ -0,0 +1,149 @@
+package nrql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PivotedPayload is a payload reshaped from long to wide: each distinct value
+// of one column (e.g., the facet `status`) becomes a column of its own,
+// holding the values of another column (e.g., `count(*)`). The remaining
+// columns identify the rows; rows which agree on all of them are merged into
+// one. Build one with `NewPivotedPayload()`. The pivot reads all of the
+// wrapped payload's rows up front.
+type PivotedPayload struct {
+	Payload
+	columns []string
+	rows    [][]interface{}
+}
+
+// `NewPivotedPayload()` pivots `p`'s `column` into columns holding the values
+// of its `value` column. The new columns are named after the values (as
+// they'd be written to a CSV; `DefaultUnknownLabel` for nulls), in the order
+// of their first appearance, and follow the remaining columns; one named
+// like a remaining column is suffixed (e.g., "host_2"), as repeated headers
+// are. A row with no value for one of the new columns gets a null. It's an
+// error for two rows to have a value for the same cell.
+func NewPivotedPayload(p Payload, column, value string) (PivotedPayload, error) {
+	columns := p.Columns()
+	c, v := -1, -1
+	for i, name := range columns {
+		switch name {
+		case column:
+			c = i
+		case value:
+			v = i
+		}
+	}
+	for _, unknown := range []struct {
+		name  string
+		index int
+	}{{column, c}, {value, v}} {
+		if unknown.index < 0 {
+			return PivotedPayload{}, fmt.Errorf(
+				"Unknown column '%s'; wanted one of: %s",
+				unknown.name,
+				strings.Join(columns, ", "),
+			)
+		}
+	}
+	if c == v {
+		return PivotedPayload{}, fmt.Errorf(
+			"Can't pivot column '%s' into its own values",
+			column,
+		)
+	}
+
+	rows, err := p.Rows()
+	if err != nil {
+		return PivotedPayload{}, err
+	}
+
+	// The columns which identify the rows, in their original order
+	var index []int
+	var wideColumns []string
+	for i, name := range columns {
+		if i != c && i != v {
+			index = append(index, i)
+			wideColumns = append(wideColumns, name)
+		}
+	}
+
+	// Rows with the same index cells are merged; the list of pivoted columns
+	// (and so the rows' widths) grows as new values of `column` turn up
+	pivoted := map[string]int{}
+	merged := map[string][]interface{}{}
+	var keys []string
+	for _, row := range rows {
+		header := labelOr(stringify(cell(row, c)), DefaultUnknownLabel)
+		col, ok := pivoted[header]
+		if !ok {
+			col = len(wideColumns)
+			pivoted[header] = col
+			wideColumns = append(wideColumns, header)
+		}
+
+		cells := make([]interface{}, len(index))
+		for i, j := range index {
+			cells[i] = cell(row, j)
+		}
+		key, err := jsonCell(cells)
+		if err != nil {
+			return PivotedPayload{}, err
+		}
+		wide, ok := merged[key]
+		if !ok {
+			keys = append(keys, key)
+			wide = cells
+		}
+		for len(wide) <= col {
+			wide = append(wide, nil)
+		}
+		if ok && wide[col] != nil {
+			return PivotedPayload{}, fmt.Errorf(
+				"More than one '%s' for '%s' = '%s' where the other "+
+					"columns are %s",
+				value,
+				column,
+				header,
+				key,
+			)
+		}
+		wide[col] = cell(row, v)
+		merged[key] = wide
+	}
+
+	wideRows := make([][]interface{}, len(keys))
+	for i, key := range keys {
+		wideRows[i] = merged[key]
+	}
+	return PivotedPayload{
+		Payload: p,
+		columns: uniqueColumns(wideColumns),
+		rows:    wideRows,
+	}, nil
+}
+
+func (p PivotedPayload) Columns() []string {
+	return append([]string(nil), p.columns...)
+}
+
+// `Rows()` returns new rows each time, so they may be modified freely. Each
+// is as wide as the columns.
+func (p PivotedPayload) Rows() ([][]interface{}, error) {
+	out := make([][]interface{}, len(p.rows))
+	for i, row := range p.rows {
+		out[i] = make([]interface{}, len(p.columns))
+		copy(out[i], row)
+	}
+	return out, nil
+}
+
+// `Kind()` is the wrapped payload's, except that a pivoted facet payload is
+// an aggregation: its facets are columns rather than rows.
+func (p PivotedPayload) Kind() PayloadKind {
+	if kind := p.Payload.Kind(); kind != PayloadKindFacet {
+		return kind
+	}
+	return PayloadKindAggregation
+}
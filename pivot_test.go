@@ -0,0 +1,77 @@
+package nrql
+
+import "testing"
+
+func TestPivotedTimeSeriesPayload(t *testing.T) {
+	p, err := NewPivotedPayload(
+		loadFixture(t, "timeseries_facet.json"),
+		"httpResponseCode",
+		"count(*)",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pivoted time series is still a time series, a row per bucket
+	checkPayload(
+		t,
+		p,
+		PayloadKindTimeSeries,
+		[]string{"beginTimeSeconds", "endTimeSeconds", "200", "500"},
+		[][]interface{}{
+			{1791932400.0, 1791932700.0, 9.0, 1.0},
+			{1791932700.0, 1791933000.0, 3.0, 0.0},
+		},
+	)
+}
+
+func TestPivotedPayloadHeaderCollisions(t *testing.T) {
+	p, err := NewPivotedPayload(
+		testTable{
+			columns: []string{"host", "name", "value"},
+			rows: [][]interface{}{
+				{"web-1", "host", 1.0},
+				{"web-1", "cpu", 2.0},
+				{"web-2", "host", 3.0},
+			},
+		},
+		"name",
+		"value",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPayload(
+		t,
+		p,
+		PayloadKindBasic,
+		[]string{"host", "host_2", "cpu"},
+		[][]interface{}{
+			{"web-1", 1.0, 2.0},
+			{"web-2", 3.0, nil},
+		},
+	)
+}
+
+func TestPivotedFacetPayload(t *testing.T) {
+	p, err := NewPivotedPayload(
+		loadFixture(t, "facet_aggregations.json"),
+		"host",
+		"count(*)",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each facet is now a column, so it's an aggregation
+	checkPayload(
+		t,
+		p,
+		PayloadKindAggregation,
+		[]string{"average(duration)", "Slowest", "web-1", "web-2"},
+		[][]interface{}{
+			{0.31, 4.2, 1200.0, nil},
+			{0.83, 9.7, nil, 323.0},
+		},
+	)
+}
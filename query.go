@@ -1,19 +1,113 @@
 package nrql
 
 import (
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Query is a structured NRQL query. It can be saved as JSON and loaded with
+// `ParseQueryJSON()`.
 type Query struct {
-	// A `nil` columns slice denotes `*`
-	Columns []string
-	Table   string
-	Where   string
-	Since   string
-	Until   string
-	Facet   string
-	Limit   int
+	// A `nil` columns slice denotes `*`. Use `As()` to give a column an
+	// alias.
+	Columns []string `json:"columns"`
+	Table   string   `json:"table"`
+	Where   string   `json:"where,omitempty"`
+	// A structured alternative to `Where`; if both are set, they're ANDed
+	WhereClause WhereClause `json:"where_clause,omitzero"`
+	Since       string      `json:"since,omitempty"`
+	Until       string      `json:"until,omitempty"`
+	// Absolute alternatives to `Since` and `Until`, which they override if
+	// non-zero. They're rendered as epoch milliseconds, so their locations
+	// are honored and New Relic can't misread their time zones.
+	SinceTime time.Time `json:"since_time,omitzero"`
+	UntilTime time.Time `json:"until_time,omitzero"`
+	Facet     string    `json:"facet,omitempty"`
+	// The most facets to return (`FACET ... LIMIT n`), separately from
+	// `Limit`; only rendered if positive, and requires `Facet`
+	FacetLimit int `json:"facet_limit,omitempty"`
+	// A negative limit denotes no LIMIT clause
+	Limit int `json:"limit"`
+	// Renders `LIMIT MAX`, overriding `Limit`
+	LimitMax bool `json:"limit_max,omitempty"`
+	// The number of results to skip; only rendered if positive, after the
+	// LIMIT clause
+	Offset int `json:"offset,omitempty"`
+	// The TIMESERIES bucket size (e.g., "1 minute", "AUTO" or "MAX"); empty
+	// for none
+	TimeSeries string `json:"timeseries,omitempty"`
+	// The SLIDE BY interval for overlapping TIMESERIES windows (e.g., "5
+	// minutes"); requires `TimeSeries`
+	SlideBy string `json:"slide_by,omitempty"`
+	// Renders `EXTRAPOLATE`, which scales the results of sampled event types
+	// up to estimates of the true totals
+	Extrapolate bool `json:"extrapolate,omitempty"`
+}
+
+// `ParseQueryJSON()` decodes a query saved as JSON (e.g., via
+// `json.Marshal()`). A missing "limit" means no LIMIT clause rather than
+// `LIMIT 0`, and a missing or null "columns" means `*`.
+func ParseQueryJSON(data []byte) (Query, error) {
+	q := Query{Limit: -1}
+	if err := json.Unmarshal(data, &q); err != nil {
+		return Query{}, fmt.Errorf("Decoding query: %v", err)
+	}
+	return q, nil
+}
+
+// `Validate()` returns an error if the query can't be rendered into valid
+// NRQL. `String()` renders the query regardless; call this first to catch
+// mistakes before spending an API call on them.
+func (q Query) Validate() error {
+	if q.Table == "" {
+		return fmt.Errorf("Missing FROM table")
+	}
+	if err := checkTimeExpr("SINCE", q.Since); err != nil {
+		return err
+	}
+	if err := checkTimeExpr("UNTIL", q.Until); err != nil {
+		return err
+	}
+	if !q.SinceTime.IsZero() && !q.UntilTime.IsZero() &&
+		!q.SinceTime.Before(q.UntilTime) {
+		return fmt.Errorf(
+			"SINCE (%s) must be before UNTIL (%s)",
+			q.SinceTime.Format(time.RFC3339Nano),
+			q.UntilTime.Format(time.RFC3339Nano),
+		)
+	}
+	if q.FacetLimit < 0 {
+		return fmt.Errorf("Invalid FACET LIMIT: %d", q.FacetLimit)
+	}
+	if q.FacetLimit > 0 && q.Facet == "" {
+		return fmt.Errorf("FACET LIMIT requires FACET")
+	}
+	if q.SlideBy != "" && q.TimeSeries == "" {
+		return fmt.Errorf("SLIDE BY requires TIMESERIES")
+	}
+	return nil
+}
+
+// `Clone()` returns a copy of the query which can be modified without
+// affecting the original; in particular, it doesn't share the original's
+// `Columns` backing array, so appending to one doesn't clobber the other. A
+// nil `Columns` (i.e., `*`) stays nil.
+func (q Query) Clone() Query {
+	if q.Columns != nil {
+		q.Columns = append(make([]string, 0, len(q.Columns)), q.Columns...)
+	}
+	return q
+}
+
+// `As()` returns a column expression which renders `expr` under the name
+// `alias` (e.g., `As("average(duration)", "Avg Duration")` yields
+// "average(duration) AS 'Avg Duration'"). The alias is quoted, so it may
+// contain spaces; it becomes the column header in the results.
+func As(expr, alias string) string {
+	return expr + " AS " + quoteString(alias)
 }
 
 func (q Query) String() string {
@@ -23,30 +117,70 @@ func (q Query) String() string {
 	}
 
 	var where string
-	if q.Where != "" {
-		where = " WHERE " + q.Where
+	if predicate := q.predicate(); predicate != "" {
+		where = " WHERE " + predicate
 	}
 
+	// The facet limit is part of the FACET clause, so it must immediately
+	// follow it; the outer LIMIT comes after
 	var facet string
 	if q.Facet != "" {
 		facet = " FACET " + q.Facet
+		if q.FacetLimit > 0 {
+			facet += " LIMIT " + strconv.Itoa(q.FacetLimit)
+		}
 	}
 
 	var limit string
-	if q.Limit >= 0 {
+	if q.LimitMax {
+		limit = " LIMIT MAX"
+	} else if q.Limit >= 0 {
 		limit = " LIMIT " + strconv.Itoa(q.Limit)
 	}
 
+	if q.Offset > 0 {
+		limit += " OFFSET " + strconv.Itoa(q.Offset)
+	}
+
 	var since string
-	if q.Since != "" {
-		since = " SINCE '" + q.Since + "'"
+	if !q.SinceTime.IsZero() {
+		since = " SINCE " + EpochMillis(q.SinceTime)
+	} else if q.Since != "" {
+		since = " SINCE " + timeExpr(q.Since)
 	}
 
 	var until string
-	if q.Until != "" {
-		until = " UNTIL '" + q.Until + "'"
+	if !q.UntilTime.IsZero() {
+		until = " UNTIL " + EpochMillis(q.UntilTime)
+	} else if q.Until != "" {
+		until = " UNTIL " + timeExpr(q.Until)
+	}
+
+	// SLIDE BY is a modifier of TIMESERIES, so it must immediately follow it
+	var timeseries string
+	if q.TimeSeries != "" {
+		timeseries = " TIMESERIES " + q.TimeSeries
+		if q.SlideBy != "" {
+			timeseries += " SLIDE BY " + q.SlideBy
+		}
+	}
+
+	var extrapolate string
+	if q.Extrapolate {
+		extrapolate = " EXTRAPOLATE"
 	}
 
 	return "SELECT " + columns + " FROM " + q.Table + where + since + until +
-		facet + limit
+		facet + limit + timeseries + extrapolate
+}
+
+// Combines the raw and structured WHERE predicates
+func (q Query) predicate() string {
+	if q.Where == "" {
+		return q.WhereClause.String()
+	}
+	if q.WhereClause.IsZero() {
+		return q.Where
+	}
+	return "(" + q.Where + ") AND (" + q.WhereClause.String() + ")"
 }
@@ -0,0 +1,134 @@
+package nrql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueryExtrapolate(t *testing.T) {
+	q := Query{
+		Columns:     []string{"count(*)"},
+		Table:       "Transaction",
+		Since:       "1 day ago",
+		Facet:       "appName",
+		Limit:       10,
+		Extrapolate: true,
+	}
+	want := "SELECT count(*) FROM Transaction SINCE 1 day ago " +
+		"FACET appName LIMIT 10 EXTRAPOLATE"
+	if got := q.String(); got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+
+	q.TimeSeries = "1 hour"
+	want = "SELECT count(*) FROM Transaction SINCE 1 day ago " +
+		"FACET appName LIMIT 10 TIMESERIES 1 hour EXTRAPOLATE"
+	if got := q.String(); got != want {
+		t.Errorf("wanted %q; got %q", want, got)
+	}
+}
+
+func TestQueryClone(t *testing.T) {
+	base := Query{
+		Columns: make([]string, 1, 4),
+		Table:   "Transaction",
+		Since:   "1 day ago",
+		Limit:   -1,
+	}
+	base.Columns[0] = "count(*)"
+	want := base.String()
+
+	clone := base.Clone()
+	clone.Columns[0] = "average(duration)"
+	clone.Columns = append(clone.Columns, "max(duration)")
+	clone.Since = "1 week ago"
+	if got := base.String(); got != want {
+		t.Errorf("modifying the clone changed the original to %q", got)
+	}
+	if base.Columns[:2][1] != "" {
+		t.Errorf("appending to the clone wrote to the original's array")
+	}
+
+	if star := (Query{Table: "T"}).Clone(); star.Columns != nil {
+		t.Errorf("the clone of a nil Columns is %#v", star.Columns)
+	}
+}
+
+func TestQueryJSONRoundTrip(t *testing.T) {
+	for _, q := range []Query{
+		{Table: "Transaction", Limit: -1},
+		{Columns: []string{}, Table: "Transaction", Limit: 0},
+		{
+			Columns:     []string{"count(*)"},
+			Table:       "Transaction",
+			WhereClause: Eq("appName", "checkout"),
+			Facet:       "host",
+			Limit:       10,
+		},
+	} {
+		data, err := json.Marshal(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.WhereClause.IsZero() &&
+			strings.Contains(string(data), "where_clause") {
+			t.Errorf("an empty WHERE clause was encoded: %s", data)
+		}
+		got, err := ParseQueryJSON(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Errorf("%s: wanted %#v; got %#v", data, q, got)
+		}
+	}
+}
+
+func TestQueryFacetLimit(t *testing.T) {
+	for _, c := range []struct {
+		q    Query
+		want string
+	}{{
+		Query{Table: "T", Facet: "host", FacetLimit: 100, Limit: -1},
+		"SELECT * FROM T FACET host LIMIT 100",
+	}, {
+		Query{
+			Table:      "T",
+			Facet:      "host",
+			FacetLimit: 100,
+			Limit:      5000,
+			Offset:     10,
+		},
+		"SELECT * FROM T FACET host LIMIT 100 LIMIT 5000 OFFSET 10",
+	}, {
+		Query{
+			Table:      "T",
+			Facet:      "host",
+			FacetLimit: 100,
+			LimitMax:   true,
+			TimeSeries: "1 hour",
+		},
+		"SELECT * FROM T FACET host LIMIT 100 LIMIT MAX TIMESERIES 1 hour",
+	}, {
+		// The facet limit is only rendered if positive
+		Query{Table: "T", Facet: "host", Limit: 10},
+		"SELECT * FROM T FACET host LIMIT 10",
+	}} {
+		if got := c.q.String(); got != c.want {
+			t.Errorf("wanted %q; got %q", c.want, got)
+		}
+	}
+}
+
+func TestQueryFacetLimitInvalid(t *testing.T) {
+	for _, q := range []Query{
+		{Table: "T", FacetLimit: 100, Limit: -1},
+		{Table: "T", Facet: "host", FacetLimit: -1, Limit: -1},
+	} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%s: wanted an error", q)
+		}
+	}
+}
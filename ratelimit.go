@@ -0,0 +1,75 @@
+package nrql
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter throttles requests to New Relic; `Wait()` blocks until a request
+// may proceed, or returns an error if `ctx` is done first. A
+// `golang.org/x/time/rate.Limiter` satisfies it, as does `TokenBucket`.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket is a RateLimiter allowing a steady number of queries per minute,
+// with bursts of up to `burst` queries. It's safe for concurrent use, so one
+// bucket can be shared by every client querying the same account.
+type TokenBucket struct {
+	interval time.Duration // between tokens
+	burst    float64
+
+	lock   sync.Mutex
+	tokens float64 // negative when there are waiters
+	last   time.Time
+}
+
+// `NewTokenBucket()` returns a bucket which refills at `perMinute` (which must
+// be positive) queries per minute and holds at most `burst` (at least 1). It
+// starts full.
+func NewTokenBucket(perMinute, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// `Wait()` takes a token, waiting for one to be refilled if there are none.
+// Waiters are served in the order they arrive.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	b.lock.Lock()
+	now := time.Now()
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// Reserve a token now, even if it has yet to be refilled, so that later
+	// waiters queue up behind us
+	b.tokens--
+	delay := time.Duration(-b.tokens * float64(b.interval))
+	b.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the reservation back for the next waiter
+		b.lock.Lock()
+		b.tokens++
+		b.lock.Unlock()
+		return ctx.Err()
+	}
+}
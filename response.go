@@ -0,0 +1,51 @@
+package nrql
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The canonical prefixes of the response headers kept in `Response.Header`:
+// New Relic's own, and those describing rate limits
+var responseHeaderPrefixes = []string{
+	"Newrelic-",
+	"X-Newrelic-",
+	"X-Ratelimit-",
+	"X-Request-Id",
+	"Retry-After",
+}
+
+// Response describes the HTTP response to a query, for callers which want
+// more than the payload (see `Client.ExecRawResponse()`).
+type Response struct {
+	// The HTTP status; zero if the payload came from the cache, or if no
+	// response was received
+	StatusCode int
+
+	// The response's New Relic, request ID and rate-limit headers (e.g.,
+	// `X-Request-Id` and `Retry-After`); other headers aren't kept. Empty if
+	// the payload came from the cache.
+	Header http.Header
+
+	// Whether the payload came from `Client.Cache` rather than New Relic
+	Cached bool
+}
+
+func newResponse(rsp *http.Response) Response {
+	header := http.Header{}
+	for name, values := range rsp.Header {
+		for _, prefix := range responseHeaderPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				header[name] = values
+				break
+			}
+		}
+	}
+	return Response{StatusCode: rsp.StatusCode, Header: header}
+}
+
+// `RequestID()` returns New Relic's ID for the request (its `X-Request-Id`
+// header), which support will ask for; empty if there wasn't one.
+func (r Response) RequestID() string {
+	return r.Header.Get("X-Request-Id")
+}
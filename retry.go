@@ -0,0 +1,85 @@
+package nrql
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// The default `RetryPolicy.Backoff`
+const DefaultRetryBackoff = 500 * time.Millisecond
+
+// RetryPolicy controls how a client retries requests to New Relic which fail
+// transiently: those which get no response (other than because the context
+// is done), HTTP 429 or an HTTP 5xx (other than `ErrQueryTooExpensive`).
+// Requests which can't even be built (e.g., for a malformed `BaseURL`) would
+// only fail again, so they aren't retried. The zero value doesn't retry.
+type RetryPolicy struct {
+	// The most attempts per query, including the first; fewer than 2 means
+	// no retries
+	MaxAttempts int
+
+	// The delay before the first retry, doubled for each one after;
+	// `DefaultRetryBackoff` if zero. Each delay is randomized (by up to
+	// half) so that clients which failed together don't retry together.
+	Backoff time.Duration
+
+	// The longest delay between attempts; unlimited if zero
+	MaxBackoff time.Duration
+}
+
+// `retryable()` returns true if a failed attempt (with the given status, or
+// zero if there was no response) is worth retrying.
+func (p RetryPolicy) retryable(ctx context.Context, status int, err error) bool {
+	switch {
+	case ctx.Err() != nil:
+		return false // the caller has given up
+	case errors.Is(err, ErrQueryTooExpensive):
+		return false // it would only fail again
+	case status == 0:
+		var transport transportError
+		return errors.As(err, &transport)
+	default:
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+}
+
+// transportError wraps the error of a request which was built but got no
+// response (e.g., a refused connection), as opposed to one which couldn't be
+// built at all; only the former are retried.
+type transportError struct {
+	error
+}
+
+func (e transportError) Unwrap() error {
+	return e.error
+}
+
+// `delay()` returns how long to wait after the `attempt`th (1-based) attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// `sleep()` waits for `d`, or returns an error if `ctx` is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
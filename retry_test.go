@@ -0,0 +1,120 @@
+package nrql
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// `countAttempts()` runs a query with `c`, retrying up to 3 attempts, and
+// returns how many it made.
+func countAttempts(t *testing.T, c Client) int {
+	t.Helper()
+	var attempts int
+	c.OnRequest = func(string) { attempts++ }
+	c.Retry = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	if _, err := c.ExecRaw("SELECT count(*) FROM T"); err == nil {
+		t.Fatal("wanted an error")
+	}
+	return attempts
+}
+
+func TestRetry(t *testing.T) {
+	var status int
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error": "nope"}`, status)
+		},
+	))
+	defer s.Close()
+	c := Client{AccountID: "1", QueryKey: "key", BaseURL: s.URL}
+
+	for _, want := range []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusBadRequest, 1},
+		{http.StatusForbidden, 1},
+	} {
+		status = want.status
+		if got := countAttempts(t, c); got != want.attempts {
+			t.Errorf(
+				"HTTP %d: wanted %d attempts; got %d",
+				want.status,
+				want.attempts,
+				got,
+			)
+		}
+	}
+}
+
+func TestRetryTransportErrors(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close() // so that the connection is refused
+	c := Client{AccountID: "1", QueryKey: "key", BaseURL: s.URL}
+	if got := countAttempts(t, c); got != 3 {
+		t.Errorf("wanted 3 attempts; got %d", got)
+	}
+}
+
+func TestRetrySkipsConfigurationErrors(t *testing.T) {
+	for _, c := range []Client{
+		{AccountID: "1", QueryKey: "key", BaseURL: "localhost"},
+		{AccountID: "1", QueryKey: "key", Region: "Mars"},
+	} {
+		if got := countAttempts(t, c); got != 1 {
+			t.Errorf("%+v: wanted 1 attempt; got %d", c, got)
+		}
+	}
+}
+
+func TestRetrySkipsTooExpensiveQueries(t *testing.T) {
+	for _, c := range []struct {
+		fixture      string
+		tooExpensive bool
+		attempts     int
+	}{
+		{"error_too_expensive.json", true, 1},
+		{"error_unavailable.json", false, 3},
+	} {
+		var requests int
+		s := fixtureServer(
+			t,
+			http.StatusServiceUnavailable,
+			c.fixture,
+			&requests,
+		)
+		_, err := Client{
+			AccountID: "1",
+			QueryKey:  "key",
+			BaseURL:   s.URL,
+			Retry:     RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+		}.ExecRaw("SELECT * FROM Transaction SINCE 10 years ago")
+
+		if got := errors.Is(err, ErrQueryTooExpensive); got != c.tooExpensive {
+			t.Errorf(
+				"%s: wanted ErrQueryTooExpensive to be %t; got %v",
+				c.fixture,
+				c.tooExpensive,
+				err,
+			)
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) ||
+			apiErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: wanted an HTTP 503 *APIError; got %v", c.fixture, err)
+		}
+		if requests != c.attempts {
+			t.Errorf(
+				"%s: wanted %d attempts; got %d",
+				c.fixture,
+				c.attempts,
+				requests,
+			)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package nrql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The units NRQL accepts in relative time expressions (e.g., "3 days ago");
+// each may also be pluralized.
+var timeUnits = map[string]bool{
+	"second":  true,
+	"minute":  true,
+	"hour":    true,
+	"day":     true,
+	"week":    true,
+	"month":   true,
+	"quarter": true,
+	"year":    true,
+}
+
+// Relative time expressions which stand alone
+var timeKeywords = map[string]bool{
+	"now":       true,
+	"today":     true,
+	"yesterday": true,
+}
+
+func isTimeUnit(s string) bool {
+	return timeUnits[strings.TrimSuffix(s, "s")]
+}
+
+// `isRelativeTime()` returns true if `s` looks like a relative time expression
+// ("3 days ago", "yesterday", "this week", ...) rather than an absolute
+// timestamp. It doesn't check that the expression is well-formed; see
+// `checkRelativeTime()`.
+func isRelativeTime(s string) bool {
+	fields := strings.Fields(strings.ToLower(s))
+	switch len(fields) {
+	case 0:
+		return false
+	case 1:
+		return timeKeywords[fields[0]]
+	case 2:
+		if fields[0] == "this" || fields[0] == "last" {
+			return true
+		}
+	}
+	return fields[len(fields)-1] == "ago"
+}
+
+// `checkRelativeTime()` validates a relative time expression.
+func checkRelativeTime(s string) error {
+	fields := strings.Fields(strings.ToLower(s))
+	switch {
+	case len(fields) == 1:
+		return nil // keywords are self-evidently valid
+	case len(fields) == 2 && (fields[0] == "this" || fields[0] == "last"):
+		if !isTimeUnit(fields[1]) {
+			return fmt.Errorf("Unknown time unit '%s' in '%s'", fields[1], s)
+		}
+		return nil
+	case len(fields) == 3:
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			return fmt.Errorf("Invalid quantity '%s' in '%s'", fields[0], s)
+		}
+		if !isTimeUnit(fields[1]) {
+			return fmt.Errorf("Unknown time unit '%s' in '%s'", fields[1], s)
+		}
+		return nil
+	}
+	return fmt.Errorf(
+		"Malformed relative time '%s'; wanted e.g. '3 days ago'",
+		s,
+	)
+}
+
+// `isEpoch()` returns true if `s` is an epoch timestamp (a bare integer),
+// which NRQL takes to be in milliseconds.
+func isEpoch(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// `EpochMillis()` renders `t` as a SINCE/UNTIL value in epoch milliseconds,
+// the absolute form NRQL accepts without any question of time zones (unlike
+// "2024-01-01 00:00:00", which New Relic reads as UTC). Sub-millisecond
+// precision is truncated.
+func EpochMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// `timeExpr()` renders a SINCE/UNTIL value. Relative expressions and epoch
+// timestamps must be unquoted, while absolute timestamps (e.g.,
+// "2017-04-11 00:00:00") must be quoted. Values which are already quoted are
+// passed through.
+func timeExpr(s string) string {
+	s = strings.TrimSpace(s)
+	if isRelativeTime(s) || isEpoch(s) ||
+		len(s) > 1 && strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") {
+		return s
+	}
+	return quoteString(s)
+}
+
+// `checkTimeExpr()` validates a SINCE/UNTIL value: relative expressions must
+// be well-formed (absolute timestamps are left for New Relic to judge).
+func checkTimeExpr(clause, s string) error {
+	if isRelativeTime(s) {
+		if err := checkRelativeTime(s); err != nil {
+			return fmt.Errorf("Invalid %s: %v", clause, err)
+		}
+	}
+	return nil
+}
+
+// The units `ParseLast()` renders durations in, largest first
+var lastUnits = []struct {
+	name string
+	size time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// `ParseDuration()` is like `time.ParseDuration()`, but it also accepts a
+// number of days (e.g., "7d"), the usual span of an extract.
+func ParseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("Invalid duration '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration '%s'", s)
+	}
+	return d, nil
+}
+
+// `ParseLast()` converts a duration (as accepted by `ParseDuration()`, e.g.
+// "30m", "24h", "1h30m" or "7d") into the relative time expression for that
+// long ago (e.g., "30 minutes ago"), as for `Query.Since`. The expression uses
+// the largest unit which divides the duration evenly, so "48h" is "2 days
+// ago".
+func ParseLast(s string) (string, error) {
+	d, err := ParseDuration(s)
+	if err != nil {
+		return "", err
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return "", fmt.Errorf(
+			"Invalid duration '%s'; wanted a whole number of seconds",
+			s,
+		)
+	}
+
+	// The last unit, a second, divides every duration which gets this far
+	unit := lastUnits[len(lastUnits)-1]
+	for _, u := range lastUnits {
+		if d%u.size == 0 {
+			unit = u
+			break
+		}
+	}
+	n := int64(d / unit.size)
+	if n != 1 {
+		return fmt.Sprintf("%d %ss ago", n, unit.name), nil
+	}
+	return fmt.Sprintf("%d %s ago", n, unit.name), nil
+}
@@ -0,0 +1,72 @@
+package nrql
+
+import "testing"
+
+func TestQuerySince(t *testing.T) {
+	for _, c := range []struct {
+		since, until string
+		want         string
+	}{
+		{"3 days ago", "", "SELECT * FROM T SINCE 3 days ago"},
+		{"1 HOUR AGO", "NOW", "SELECT * FROM T SINCE 1 HOUR AGO UNTIL NOW"},
+		{"yesterday", "today", "SELECT * FROM T SINCE yesterday UNTIL today"},
+		{"last week", "", "SELECT * FROM T SINCE last week"},
+		{"1700000000000", "", "SELECT * FROM T SINCE 1700000000000"},
+		{
+			"2024-01-01 00:00:00",
+			"2024-01-02 00:00:00",
+			"SELECT * FROM T SINCE '2024-01-01 00:00:00' " +
+				"UNTIL '2024-01-02 00:00:00'",
+		},
+		{"'2024-01-01'", "", "SELECT * FROM T SINCE '2024-01-01'"},
+	} {
+		q := Query{Table: "T", Limit: -1, Since: c.since, Until: c.until}
+		if err := q.Validate(); err != nil {
+			t.Errorf("%q/%q: %v", c.since, c.until, err)
+		}
+		if got := q.String(); got != c.want {
+			t.Errorf("wanted %q; got %q", c.want, got)
+		}
+	}
+}
+
+func TestQuerySinceInvalid(t *testing.T) {
+	for _, since := range []string{
+		"three days ago",
+		"3 fortnights ago",
+		"this fortnight",
+		"3 days from now ago",
+	} {
+		q := Query{Table: "T", Limit: -1, Since: since}
+		if err := q.Validate(); err == nil {
+			t.Errorf("%q: wanted an error", since)
+		}
+	}
+}
+
+func TestParseLast(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"7d", "7 days ago"},
+		{"48h", "2 days ago"},
+		{"24h", "1 day ago"},
+		{"1h30m", "90 minutes ago"},
+		{"1h", "1 hour ago"},
+		{"90s", "90 seconds ago"},
+		{"1s", "1 second ago"},
+	} {
+		got, err := ParseLast(c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+		} else if got != c.want {
+			t.Errorf("%s: wanted %q; got %q", c.in, c.want, got)
+		}
+	}
+
+	for _, in := range []string{"", "0s", "500ms", "1.5s", "-1h", "week"} {
+		if got, err := ParseLast(in); err == nil {
+			t.Errorf("%q: wanted an error; got %q", in, got)
+		}
+	}
+}
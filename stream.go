@@ -0,0 +1,111 @@
+package nrql
+
+import (
+	"context"
+	"fmt"
+)
+
+// `Stream()` runs `q` and sends its results on the returned channel as they
+// arrive: first the column headers (as strings), then each row. Queries which
+// return events are fetched page by page, as by `ExecAll()` (so `q.Limit` caps
+// the total rather than the page size), and at most one page is held in
+// memory however many rows there are; any other query is run as given, and
+// its results are sent from its single payload.
+//
+// The row channel is closed at the end of the results; by then, the error
+// channel holds the error which ended them early, if any (e.g., `ctx`'s, if
+// it's done mid-stream), and is closed too. The caller must either drain the
+// rows or cancel `ctx`, or the stream is left blocked.
+func (c Client) Stream(
+	ctx context.Context,
+	q Query,
+) (<-chan []interface{}, <-chan error) {
+	rows := make(chan []interface{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(rows)
+		if err := c.stream(ctx, q, rows); err != nil {
+			errs <- err
+		}
+		close(errs)
+	}()
+	return rows, errs
+}
+
+func (c Client) stream(
+	ctx context.Context,
+	q Query,
+	out chan<- []interface{},
+) error {
+	send := func(row []interface{}) error {
+		// A select with both cases ready picks one at random, so check
+		// first that the caller hasn't given up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case out <- row:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.LazyEvents = false // the pages' columns are unified
+	pages := pager{q: q}
+	p, pageable, err := c.firstPage(ctx, &pages)
+	if err != nil {
+		return err
+	}
+	columns := p.Columns()
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	if err := send(header); err != nil {
+		return err
+	}
+
+	var total int
+	for page := 1; ; page++ {
+		if page > 1 {
+			pq, ok := pages.next()
+			if !ok {
+				return nil
+			}
+			if p, err = c.ExecContext(ctx, pq); err != nil {
+				return err
+			}
+			basic, ok := p.(*PayloadBasic)
+			if !ok {
+				return fmt.Errorf(
+					"Page %d of '%s' is a %s payload; wanted events",
+					page,
+					pq,
+					p.Kind(),
+				)
+			}
+			// Every page's rows go under the first page's headers, which
+			// (for `SELECT *`) needn't be in the same order as this page's
+			basic.cols = columns
+		}
+
+		rows, err := p.Rows()
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := send(row); err != nil {
+				return err
+			}
+		}
+		if !pageable {
+			return nil
+		}
+		total += len(rows)
+		pages.add(len(rows))
+		if c.OnPage != nil {
+			c.OnPage(page, total)
+		}
+	}
+}
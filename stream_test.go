@@ -0,0 +1,77 @@
+package nrql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// `collect()` drains the stream of `q`, returning its header and rows.
+func collect(
+	t *testing.T,
+	c Client,
+	q Query,
+) ([]interface{}, [][]interface{}) {
+	t.Helper()
+	rows, errs := c.Stream(context.Background(), q)
+	var header []interface{}
+	var got [][]interface{}
+	for row := range rows {
+		if header == nil {
+			header = row
+			continue
+		}
+		got = append(got, row)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return header, got
+}
+
+func TestStreamPages(t *testing.T) {
+	s := newEventServer(t, 5001)
+	header, rows := collect(
+		t,
+		s.client(),
+		Query{Columns: []string{"i"}, Table: "T", Limit: -1},
+	)
+	if !reflect.DeepEqual(header, []interface{}{"i"}) {
+		t.Errorf("wanted header [i]; got %v", header)
+	}
+	checkEvents(t, rows, 5001)
+	if n := len(s.sent()); n != 2 {
+		t.Errorf("wanted 2 pages; got %d", n)
+	}
+}
+
+func TestStreamKeepsLimit(t *testing.T) {
+	s := newEventServer(t, 5001)
+	_, rows := collect(
+		t,
+		s.client(),
+		Query{Columns: []string{"i"}, Table: "T", Limit: 10},
+	)
+	checkEvents(t, rows, 10)
+	want := []string{"SELECT i FROM T LIMIT 10"}
+	if got := s.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted queries %q; got %q", want, got)
+	}
+
+	s = newEventServer(t, 0)
+	_, rows = collect(
+		t,
+		s.client(),
+		Query{Table: "T", Facet: "appName", Limit: -1},
+	)
+	if !reflect.DeepEqual(rows, [][]interface{}{{"a", 1.0}}) {
+		t.Errorf("wanted the facet's row; got %v", rows)
+	}
+	want = []string{
+		"SELECT * FROM T FACET appName LIMIT 5000",
+		"SELECT * FROM T FACET appName",
+	}
+	if got := s.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted queries %q; got %q", want, got)
+	}
+}
@@ -0,0 +1,183 @@
+package nrql
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The default `TableOptions.MaxWidth`
+const DefaultTableMaxWidth = 40
+
+// TableOptions controls the formatting of `FormatTableWithOptions()`. The zero
+// value yields the same output as `FormatTable()`.
+type TableOptions struct {
+	// Cells wider than this many characters are truncated with an ellipsis;
+	// `DefaultTableMaxWidth` if zero, and unlimited if negative
+	MaxWidth int
+
+	// Overrides the formatting of the named columns, as in `CSVOptions`
+	ColumnFormats map[string]ColumnFormat
+
+	// If set, only these columns are shown, in this order, as in
+	// `CSVOptions`
+	Columns []string
+
+	// Renames the named columns in the header row, as in `CSVOptions`
+	Rename map[string]string
+
+	// If positive, only the first this many rows are shown, as in
+	// `CSVOptions`
+	MaxRows int
+
+	// If set, this is inserted between each group of three digits in
+	// numbers (e.g., "," for "1,234,567.89"), in columns without a
+	// `ColumnFormats` entry. The output's no longer machine-parseable, which
+	// is why this isn't offered for CSV.
+	GroupSeparator string
+
+	// Whether to prepend a column numbering the rows from 1, as in
+	// `CSVOptions`
+	AddRowNumber bool
+
+	// The header of the `AddRowNumber` column; `DefaultRowNumberHeader` if
+	// empty
+	RowNumberHeader string
+
+	// Whether to embolden the header row with ANSI escape codes; only set
+	// this when writing to a terminal which supports them
+	Color bool
+}
+
+// ANSI escape codes
+const (
+	ansiBold  = "\x1b[1m"
+	ansiReset = "\x1b[0m"
+)
+
+// `FormatTable()` writes `payload` to `w` as a plain-text table for reading
+// on a terminal: a header row and then one line per row, with the columns
+// padded to line up (like `column -t`). Columns whose values are all numeric
+// are right-aligned, and everything else is left-aligned. It's meant for
+// people, not programs; use `FormatCSV()` for the latter.
+func FormatTable(w io.Writer, payload Payload) error {
+	return FormatTableWithOptions(w, payload, TableOptions{})
+}
+
+// `FormatTableWithOptions()` is like `FormatTable()`, formatted according to
+// `opts`.
+func FormatTableWithOptions(
+	w io.Writer,
+	payload Payload,
+	opts TableOptions,
+) error {
+	headers := payload.Columns()
+	rows, err := headRows(payload, opts.MaxRows)
+	if err != nil {
+		return err
+	}
+	headers, rows, err = selectColumns(headers, rows, opts.Columns)
+	if err != nil {
+		return err
+	}
+
+	maxWidth := opts.MaxWidth
+	if maxWidth == 0 {
+		maxWidth = DefaultTableMaxWidth
+	}
+
+	defaultFormat := stringify
+	if opts.GroupSeparator != "" {
+		defaultFormat = numeric(func(x float64) string {
+			return groupDigits(stringify(x), opts.GroupSeparator)
+		})
+	}
+	formats := make([]ColumnFormat, len(headers))
+	for i, header := range headers {
+		if formats[i] = opts.ColumnFormats[header]; formats[i] == nil {
+			formats[i] = defaultFormat
+		}
+	}
+
+	// Every cell has to be formatted up front to know how wide the columns
+	// are. The row number, if any, goes in an extra first column.
+	var offset int
+	if opts.AddRowNumber {
+		offset = 1
+	}
+	lines := make([][]string, 0, len(rows)+1)
+	lines = append(lines, make([]string, offset+len(headers)))
+	if opts.AddRowNumber {
+		lines[0][0] = tableCell(rowNumberHeader(opts.RowNumberHeader), maxWidth)
+	}
+	for i, header := range renameColumns(headers, opts.Rename) {
+		lines[0][offset+i] = tableCell(header, maxWidth)
+	}
+	for n, row := range rows {
+		line := make([]string, offset+len(headers))
+		if opts.AddRowNumber {
+			line[0] = strconv.Itoa(n + 1)
+		}
+		for i := range headers {
+			line[offset+i] = tableCell(formats[i](cell(row, i)), maxWidth)
+		}
+		lines = append(lines, line)
+	}
+
+	widths := make([]int, offset+len(headers))
+	for _, line := range lines {
+		for i, s := range line {
+			if n := utf8.RuneCountInString(s); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	rightAlign := make([]bool, offset+len(headers))
+	if opts.AddRowNumber {
+		rightAlign[0] = true
+	}
+	for i := range headers {
+		rightAlign[offset+i] = isNumericColumn(rows, i)
+	}
+
+	bw := bufio.NewWriter(w)
+	var b strings.Builder
+	for l, line := range lines {
+		b.Reset()
+		for i, s := range line {
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(s))
+			// The escape codes mustn't count towards the padding
+			if l == 0 && opts.Color {
+				s = ansiBold + s + ansiReset
+			}
+			if rightAlign[i] {
+				b.WriteString(pad + s)
+			} else {
+				b.WriteString(s + pad)
+			}
+		}
+		// Padding is pointless (and a nuisance to copy) at the end of a line
+		bw.WriteString(strings.TrimRight(b.String(), " "))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// `tableCell()` flattens `s` onto one line and truncates it to `maxWidth`
+// characters (if `maxWidth` is positive), marking the truncation with an
+// ellipsis.
+func tableCell(s string, maxWidth int) string {
+	s = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ").
+		Replace(s)
+	if maxWidth <= 0 || utf8.RuneCountInString(s) <= maxWidth {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxWidth-1]) + "…"
+}
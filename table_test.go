@@ -0,0 +1,106 @@
+package nrql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatTableMaxRows(t *testing.T) {
+	var fetched int
+	p := countingPayload{rows: 100, fetched: &fetched}
+	var b strings.Builder
+	if err := FormatTableWithOptions(&b, p, TableOptions{MaxRows: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(b.String(), "\n"); lines != 4 {
+		t.Errorf("wanted a header and 3 rows; got:\n%s", b.String())
+	}
+	if fetched != 3 {
+		t.Errorf("iterated over %d rows; wanted only 3", fetched)
+	}
+}
+
+// `formatTable()` returns `p` formatted with `opts`, failing the test on
+// error.
+func formatTable(t *testing.T, p Payload, opts TableOptions) string {
+	t.Helper()
+	var b strings.Builder
+	if err := FormatTableWithOptions(&b, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestFormatTableAlignment(t *testing.T) {
+	p := testTable{
+		columns: []string{"host", "count", "p99", "note"},
+		rows: [][]interface{}{
+			{"web-1", 3.0, nil, 1.0},
+			{"web-10", 1234.0, 2.5, "n/a"},
+			{"db", 12.0, 250.0, nil},
+		},
+	}
+	// Numbers line up on the right, even among nulls, but a column with any
+	// non-numeric values is left-aligned like text
+	want := strings.Join([]string{
+		"host    count  p99  note",
+		"web-1       3       1",
+		"web-10   1234  2.5  n/a",
+		"db         12  250",
+		"",
+	}, "\n")
+	if got := formatTable(t, p, TableOptions{}); got != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestFormatTableColor(t *testing.T) {
+	p := testTable{
+		columns: []string{"host", "count"},
+		rows:    [][]interface{}{{"web-1", 3.0}},
+	}
+	want := "\x1b[1mhost\x1b[0m   \x1b[1mcount\x1b[0m\nweb-1      3\n"
+	if got := formatTable(t, p, TableOptions{Color: true}); got != want {
+		t.Errorf("Color: wanted %q; got %q", want, got)
+	}
+
+	// E.g., for --color never or $NO_COLOR
+	want = "host   count\nweb-1      3\n"
+	if got := formatTable(t, p, TableOptions{}); got != want {
+		t.Errorf("no Color: wanted %q; got %q", want, got)
+	}
+}
+
+func TestFormatTableMaxWidth(t *testing.T) {
+	for _, c := range []struct {
+		max        int
+		cell, want string
+	}{
+		{5, "abcdefgh", "abcd…"},
+		{5, "abcde", "abcde"},
+		{5, "ééééééé", "éééé…"},
+		{5, "ab\ncd\tef", "ab c…"},
+		{0, strings.Repeat("x", 50), strings.Repeat("x", 39) + "…"},
+		{-1, strings.Repeat("x", 50), strings.Repeat("x", 50)},
+	} {
+		p := testTable{
+			columns: []string{"c"},
+			rows:    [][]interface{}{{c.cell}},
+		}
+		got := formatTable(t, p, TableOptions{MaxWidth: c.max})
+		if want := "c\n" + c.want + "\n"; got != want {
+			t.Errorf("MaxWidth %d: wanted %q; got %q", c.max, want, got)
+		}
+	}
+
+	// Headers are truncated too, and the ellipsis counts as one character
+	// when the columns are lined up
+	p := testTable{
+		columns: []string{"hostname", "count"},
+		rows:    [][]interface{}{{"web", 3.0}},
+	}
+	want := "host…  count\nweb        3\n"
+	if got := formatTable(t, p, TableOptions{MaxWidth: 5}); got != want {
+		t.Errorf("header: wanted %q; got %q", want, got)
+	}
+}
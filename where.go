@@ -0,0 +1,233 @@
+package nrql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WhereClause is a structured WHERE predicate. Unlike the raw `Query.Where`
+// string, the values passed to the constructors below are quoted and escaped,
+// so it's safe to build a WhereClause from untrusted input (e.g., the query
+// parameters of an HTTP request). The zero value is the empty predicate.
+type WhereClause struct {
+	nrql string
+}
+
+// `String()` returns the NRQL for the predicate (without the WHERE keyword).
+func (c WhereClause) String() string {
+	return c.nrql
+}
+
+// `IsZero()` returns true if the predicate is empty.
+func (c WhereClause) IsZero() bool {
+	return c.nrql == ""
+}
+
+// `MarshalJSON()` encodes the predicate as its NRQL string.
+func (c WhereClause) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.nrql)
+}
+
+// `UnmarshalJSON()` decodes a predicate encoded by `MarshalJSON()`. The NRQL
+// is taken verbatim, so unlike a predicate built with the constructors below,
+// a decoded predicate is only as safe as the JSON it came from.
+func (c *WhereClause) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &c.nrql)
+}
+
+// `Eq()` matches events whose `attr` equals `value`. A nil value matches
+// events for which `attr` IS NULL.
+func Eq(attr string, value interface{}) WhereClause {
+	if value == nil {
+		return WhereClause{quoteAttribute(attr) + " IS NULL"}
+	}
+	return compare(attr, "=", value)
+}
+
+// `Ne()` matches events whose `attr` doesn't equal `value`. A nil value
+// matches events for which `attr` IS NOT NULL.
+func Ne(attr string, value interface{}) WhereClause {
+	if value == nil {
+		return WhereClause{quoteAttribute(attr) + " IS NOT NULL"}
+	}
+	return compare(attr, "!=", value)
+}
+
+// `Lt()` matches events whose `attr` is less than `value`.
+func Lt(attr string, value interface{}) WhereClause {
+	return compare(attr, "<", value)
+}
+
+// `Gt()` matches events whose `attr` is greater than `value`.
+func Gt(attr string, value interface{}) WhereClause {
+	return compare(attr, ">", value)
+}
+
+// `Like()` matches events whose `attr` matches the LIKE `pattern`. The pattern
+// is quoted, but its `%` wildcards are passed through.
+func Like(attr, pattern string) WhereClause {
+	return compare(attr, "LIKE", pattern)
+}
+
+// `In()` matches events whose `attr` is one of `values`. An empty value list
+// (or one of only NaNs and infinities) matches nothing; NRQL has no literal for "false", so it's rendered as a
+// predicate which can never be true, `(attr IS NULL AND attr IS NOT NULL)`.
+// `Client.ExecIn()` skips the query altogether instead.
+func In(attr string, values ...interface{}) WhereClause {
+	// No attribute equals a NaN or an infinity (see `compare()`)
+	literals := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, ok := nonFinite(value); !ok {
+			literals = append(literals, quoteValue(value))
+		}
+	}
+	if len(literals) == 0 {
+		return never(attr)
+	}
+	return WhereClause{
+		quoteAttribute(attr) + " IN (" + strings.Join(literals, ", ") + ")",
+	}
+}
+
+// `And()` matches events which match all of `clauses`. Empty clauses are
+// ignored.
+func And(clauses ...WhereClause) WhereClause {
+	return join(" AND ", clauses)
+}
+
+// `Or()` matches events which match any of `clauses`. Empty clauses are
+// ignored.
+func Or(clauses ...WhereClause) WhereClause {
+	return join(" OR ", clauses)
+}
+
+// `Not()` negates `clause`. Negating the empty predicate yields the empty
+// predicate.
+func Not(clause WhereClause) WhereClause {
+	if clause.IsZero() {
+		return clause
+	}
+	return WhereClause{"NOT (" + clause.nrql + ")"}
+}
+
+// `never()` returns a predicate on `attr` which no event matches, in place
+// of the "false" NRQL lacks; negating it matches every event.
+func never(attr string) WhereClause {
+	attr = quoteAttribute(attr)
+	return WhereClause{"(" + attr + " IS NULL AND " + attr + " IS NOT NULL)"}
+}
+
+// NRQL has no literal for NaN or the infinities, but no attribute holds one
+// either, so a comparison with one is decided as it would be for every finite
+// number: `!=` is true (as is `<` +Inf and `>` -Inf) of any event with the
+// attribute, and the rest are never true.
+func compare(attr, op string, value interface{}) WhereClause {
+	if f, ok := nonFinite(value); ok {
+		if op == "!=" || op == "<" && math.IsInf(f, 1) ||
+			op == ">" && math.IsInf(f, -1) {
+			return WhereClause{quoteAttribute(attr) + " IS NOT NULL"}
+		}
+		return never(attr)
+	}
+	return WhereClause{quoteAttribute(attr) + " " + op + " " + quoteValue(value)}
+}
+
+// Each sub-clause is parenthesized so that precedence is explicit regardless
+// of how the clauses were built.
+func join(sep string, clauses []WhereClause) WhereClause {
+	parts := make([]string, 0, len(clauses))
+	for _, clause := range clauses {
+		if !clause.IsZero() {
+			parts = append(parts, clause.nrql)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return WhereClause{}
+	case 1:
+		return WhereClause{parts[0]}
+	}
+	return WhereClause{"(" + strings.Join(parts, ")"+sep+"(") + ")"}
+}
+
+// Attribute names which aren't plain identifiers (e.g., those containing
+// spaces or dashes) must be wrapped in backticks. NRQL has no escape sequence
+// for a backtick inside a backticked name, and no real attribute can contain
+// one, so they're dropped rather than allowed to terminate the quoting.
+func quoteAttribute(attr string) string {
+	attr = strings.Replace(attr, "`", "", -1)
+	if isIdentifier(attr) {
+		return attr
+	}
+	return "`" + attr + "`"
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r == '.' || r >= '0' && r <= '9'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Numbers (including those of named types, e.g. `type Code int`, and
+// `time.Duration`, in nanoseconds) and booleans are emitted as literals, and
+// a `time.Time` as epoch milliseconds, as New Relic's `timestamp` is;
+// everything else is formatted as a string and single-quoted with
+// backslashes and quotes escaped. NaN and infinities have no literal; see
+// `nonFinite()`.
+func quoteValue(value interface{}) string {
+	switch x := value.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return EpochMillis(x)
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.String:
+		return quoteString(v.String())
+	}
+	return quoteString(fmt.Sprint(value))
+}
+
+// `nonFinite()` returns `value` if it's a NaN or an infinity (of any float
+// type), and false otherwise.
+func nonFinite(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+		return 0, false
+	}
+	f := v.Float()
+	return f, math.IsNaN(f) || math.IsInf(f, 0)
+}
+
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	return "'" + s + "'"
+}
@@ -0,0 +1,171 @@
+package nrql
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWhereClauseEscapesValues(t *testing.T) {
+	for _, c := range []struct {
+		clause WhereClause
+		want   string
+	}{
+		{Eq("name", "O'Brien"), `name = 'O\'Brien'`},
+		{Eq("path", `C:\temp`), `path = 'C:\\temp'`},
+		{Eq("name", `\'`), `name = '\\\''`},
+		{
+			Eq("name", "x' OR 1 = 1 OR name = 'y"),
+			`name = 'x\' OR 1 = 1 OR name = \'y'`,
+		},
+		{
+			Eq("name", `x\' OR true OR name = '`),
+			`name = 'x\\\' OR true OR name = \''`,
+		},
+		{Like("name", "%O'Brien%"), `name LIKE '%O\'Brien%'`},
+		{Ne("name", "a'b"), `name != 'a\'b'`},
+		{In("name", "a'", `b\`), `name IN ('a\'', 'b\\')`},
+		{Eq("code", 500), "code = 500"},
+		{Eq("ok", true), "ok = true"},
+		{Gt("duration", 1.5), "duration > 1.5"},
+		{Lt("duration", float32(0.25)), "duration < 0.25"},
+		{Eq("name", nil), "name IS NULL"},
+		{Ne("name", nil), "name IS NOT NULL"},
+	} {
+		if got := c.clause.String(); got != c.want {
+			t.Errorf("wanted %s; got %s", c.want, got)
+		}
+	}
+}
+
+func TestWhereClauseQuotesAttributes(t *testing.T) {
+	for _, c := range []struct {
+		attr, want string
+	}{
+		{"appName", "appName = 1"},
+		{"request.uri", "request.uri = 1"},
+		{"_private2", "_private2 = 1"},
+		{"http-status", "`http-status` = 1"},
+		{"my attribute", "`my attribute` = 1"},
+		{"2xx", "`2xx` = 1"},
+
+		// A backtick can't end the quoting early
+		{"a` = 1 OR `b", "`a = 1 OR b` = 1"},
+		{"`appName`", "appName = 1"},
+	} {
+		if got := Eq(c.attr, 1).String(); got != c.want {
+			t.Errorf("%q: wanted %s; got %s", c.attr, c.want, got)
+		}
+	}
+}
+
+func TestWhereClauseNesting(t *testing.T) {
+	a, b, c := Eq("a", 1), Eq("b", 2), Eq("c", 3)
+	for _, tc := range []struct {
+		clause WhereClause
+		want   string
+	}{
+		{And(), ""},
+		{And(a), "a = 1"},
+		{And(a, WhereClause{}), "a = 1"},
+		{And(a, b), "(a = 1) AND (b = 2)"},
+		{Or(a, b, c), "(a = 1) OR (b = 2) OR (c = 3)"},
+		{And(a, Or(b, c)), "(a = 1) AND ((b = 2) OR (c = 3))"},
+		{Or(And(a, b), c), "((a = 1) AND (b = 2)) OR (c = 3)"},
+		{Not(a), "NOT (a = 1)"},
+		{Not(WhereClause{}), ""},
+		{Not(Or(a, b)), "NOT ((a = 1) OR (b = 2))"},
+		{And(Not(a), Not(b)), "(NOT (a = 1)) AND (NOT (b = 2))"},
+		{Or(WhereClause{}, Not(And(a, b))), "NOT ((a = 1) AND (b = 2))"},
+	} {
+		if got := tc.clause.String(); got != tc.want {
+			t.Errorf("wanted %q; got %q", tc.want, got)
+		}
+	}
+}
+
+func TestQueryWhereClause(t *testing.T) {
+	q := Query{
+		Table:       "Transaction",
+		Where:       "a = 1 OR b = 2",
+		WhereClause: Eq("name", "x' OR '1' = '1"),
+		Limit:       -1,
+	}
+	want := `SELECT * FROM Transaction WHERE (a = 1 OR b = 2) AND ` +
+		`(name = 'x\' OR \'1\' = \'1')`
+	if got := q.String(); got != want {
+		t.Errorf("wanted %s; got %s", want, got)
+	}
+}
+
+func TestInEmpty(t *testing.T) {
+	for _, c := range []struct {
+		clause WhereClause
+		want   string
+	}{
+		{In("name"), "(name IS NULL AND name IS NOT NULL)"},
+		{In("my name"), "(`my name` IS NULL AND `my name` IS NOT NULL)"},
+		{Not(In("name")), "NOT ((name IS NULL AND name IS NOT NULL))"},
+		{
+			Or(Eq("a", 1), In("name")),
+			"(a = 1) OR ((name IS NULL AND name IS NOT NULL))",
+		},
+	} {
+		if got := c.clause.String(); got != c.want {
+			t.Errorf("wanted %s; got %s", c.want, got)
+		}
+	}
+}
+
+type testCode int16
+
+type testName string
+
+func TestWhereClauseValueTypes(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		clause WhereClause
+		want   string
+	}{
+		{Eq("code", int8(-5)), "code = -5"},
+		{Eq("code", int16(500)), "code = 500"},
+		{Eq("code", uint8(5)), "code = 5"},
+		{Eq("code", uint16(500)), "code = 500"},
+		{Eq("code", uintptr(7)), "code = 7"},
+		{Eq("code", testCode(404)), "code = 404"},
+		{Eq("name", testName("it's")), `name = 'it\'s'`},
+		{Gt("timestamp", at), "timestamp > 1704067200000"},
+		{Lt("duration", time.Second), "duration < 1000000000"},
+		{In("code", int16(1), testCode(2)), "code IN (1, 2)"},
+	} {
+		if got := c.clause.String(); got != c.want {
+			t.Errorf("wanted %s; got %s", c.want, got)
+		}
+	}
+}
+
+func TestWhereClauseNonFinite(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	const never = "(a IS NULL AND a IS NOT NULL)"
+	for _, c := range []struct {
+		clause WhereClause
+		want   string
+	}{
+		{Eq("a", nan), never},
+		{Ne("a", nan), "a IS NOT NULL"},
+		{Lt("a", nan), never},
+		{Gt("a", float32(nan)), never},
+		{Eq("a", inf), never},
+		{Ne("a", -inf), "a IS NOT NULL"},
+		{Lt("a", inf), "a IS NOT NULL"},
+		{Gt("a", inf), never},
+		{Lt("a", -inf), never},
+		{Gt("a", -inf), "a IS NOT NULL"},
+		{In("a", nan, 1.5, inf), "a IN (1.5)"},
+		{In("a", nan, -inf), never},
+	} {
+		if got := c.clause.String(); got != c.want {
+			t.Errorf("wanted %s; got %s", c.want, got)
+		}
+	}
+}
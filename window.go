@@ -0,0 +1,195 @@
+package nrql
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fixed-length units of relative times `ExecWindowed()` can resolve;
+// months and the like vary in length, so they're left out.
+var windowUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// The absolute timestamp layouts `ExecWindowed()` understands; timestamps
+// without a zone are UTC, as in NRQL.
+var windowLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC3339,
+}
+
+// `ExecWindowed()` is like `Exec()`, but it splits the SINCE...UNTIL range of
+// `q` into consecutive windows of `window` (the last may be shorter), runs a
+// query for each, and returns their events as a single payload. This keeps
+// each query within LIMIT MAX and the API's time budget when extracting a
+// long range of events; choose a window small enough that none of them hit
+// `q`'s limit, or events will be missed (a warning is logged via `c.Logger`
+// if one does).
+//
+// `q.SinceTime` or `q.Since` must be set, the latter as epoch milliseconds,
+// an absolute timestamp (e.g., "2017-04-11 00:00:00") or a relative time in
+// seconds to weeks (e.g., "7 days ago"); an empty `q.Until` (and
+// `q.UntilTime`) means now. Relative times are resolved once,
+// up front, so the windows don't drift as they're run. Only queries which
+// return events (rather than aggregations) can be windowed.
+func (c Client) ExecWindowed(q Query, window time.Duration) (Payload, error) {
+	return c.ExecWindowedContext(context.Background(), q, window)
+}
+
+// `ExecWindowedContext()` is like `ExecWindowed()`, but the requests are
+// aborted when `ctx` is done.
+func (c Client) ExecWindowedContext(
+	ctx context.Context,
+	q Query,
+	window time.Duration,
+) (Payload, error) {
+	buckets, err := q.Buckets(window)
+	if err != nil {
+		return nil, err
+	}
+
+	c.LazyEvents = false // the buckets are combined
+	var all *PayloadBasic
+	for _, bucket := range buckets {
+		p, err := c.ExecContext(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		basic, ok := p.(*PayloadBasic)
+		if !ok {
+			return nil, fmt.Errorf(
+				"'%s' is a %s payload; only events can be windowed",
+				bucket,
+				p.Kind(),
+			)
+		}
+
+		events := basic.Results[0].Events
+		if limit := windowLimit(q); limit > 0 && len(events) >= limit {
+			loggerOr(c.Logger).Printf(
+				"nrql: window %s to %s hit the limit of %d rows; some "+
+					"events were probably missed (use a smaller window)",
+				bucket.SinceTime.UTC().Format(time.RFC3339),
+				bucket.UntilTime.UTC().Format(time.RFC3339),
+				limit,
+			)
+		}
+		if all == nil {
+			all = basic
+		} else {
+			all.Results[0].Events = append(all.Results[0].Events, events...)
+		}
+	}
+	return all, nil
+}
+
+// `Buckets()` splits the SINCE...UNTIL range of `q` into consecutive buckets
+// of `step` (the last may be shorter), and returns a copy of `q` for each,
+// with `SinceTime` and `UntilTime` set to its bounds; e.g., to extract a
+// metric day by day, one file per day. The range is resolved as for
+// `ExecWindowed()`: `q.SinceTime` or `q.Since` must be set, and relative
+// times are resolved once, up front.
+func (q Query) Buckets(step time.Duration) ([]Query, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("Bucket size must be positive; got %v", step)
+	}
+	if q.Since == "" && q.SinceTime.IsZero() {
+		return nil, fmt.Errorf("Bucketed queries require a SINCE clause")
+	}
+
+	now := time.Now()
+	since := q.SinceTime
+	if since.IsZero() {
+		var err error
+		if since, err = parseTimeBound(q.Since, now); err != nil {
+			return nil, fmt.Errorf("Invalid SINCE: %v", err)
+		}
+	}
+	until := q.UntilTime
+	if until.IsZero() {
+		until = now
+		if q.Until != "" {
+			var err error
+			if until, err = parseTimeBound(q.Until, now); err != nil {
+				return nil, fmt.Errorf("Invalid UNTIL: %v", err)
+			}
+		}
+	}
+	if !since.Before(until) {
+		return nil, fmt.Errorf(
+			"SINCE (%s) must be before UNTIL (%s)",
+			since.UTC().Format(time.RFC3339),
+			until.UTC().Format(time.RFC3339),
+		)
+	}
+
+	var buckets []Query
+	for start := since; start.Before(until); start = start.Add(step) {
+		end := start.Add(step)
+		if end.After(until) {
+			end = until
+		}
+		bucket := q.Clone()
+		bucket.SinceTime, bucket.UntilTime = start, end
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// `windowLimit()` returns the most events a query for one window can return.
+// Without a LIMIT clause, New Relic returns at most 100.
+func windowLimit(q Query) int {
+	switch {
+	case q.LimitMax:
+		return MaxPageSize
+	case q.Limit < 0:
+		return 100
+	default:
+		return q.Limit
+	}
+}
+
+// `parseTimeBound()` resolves a SINCE/UNTIL value to a time, relative to
+// `now` if need be.
+func parseTimeBound(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 1 && strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") {
+		s = s[1 : len(s)-1]
+	}
+
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 1 && fields[0] == "now" {
+		return now, nil
+	}
+	if len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.ParseFloat(fields[0], 64)
+		unit, ok := windowUnits[strings.TrimSuffix(fields[1], "s")]
+		if err == nil && ok {
+			return now.Add(-time.Duration(n * float64(unit))), nil
+		}
+	}
+
+	for _, layout := range windowLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(
+		"Can't resolve '%s' to a time; wanted epoch milliseconds, a "+
+			"timestamp like '2017-04-11 00:00:00', or e.g. '7 days ago'",
+		s,
+	)
+}
@@ -0,0 +1,171 @@
+package nrql
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+)
+
+// The static parts of the workbook. Style 1 (bold) is applied to the header
+// row; everything else uses the default style 0.
+var xlsxStaticParts = []struct{ name, content string }{{
+	"[Content_Types].xml",
+	`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+</Types>`,
+}, {
+	"_rels/.rels",
+	`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`,
+}, {
+	"xl/workbook.xml",
+	`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Results" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`,
+}, {
+	"xl/_rels/workbook.xml.rels",
+	`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`,
+}, {
+	"xl/styles.xml",
+	`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>
+</styleSheet>`,
+}}
+
+// The MIME type of the output of `FormatXLSX()`
+const XLSXContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// `FormatXLSX()` writes `payload` to `w` as an Excel workbook with a single
+// sheet. The header row is bold, and numeric (and boolean) cells are typed as
+// such rather than as text, so they can be summed, charted, etc. without
+// conversion.
+func FormatXLSX(w io.Writer, payload Payload) error {
+	headers := payload.Columns()
+	rows, err := payload.Rows()
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	if err := writeXLSXSheet(f, headers, rows); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeXLSXSheet(w io.Writer, headers []string, rows [][]interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		"\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetData>`)
+
+	// Write the header row
+	buf.WriteString(`<row r="1">`)
+	for i, header := range headers {
+		writeXLSXCell(&buf, cellRef(i, 1), header, 1)
+	}
+	buf.WriteString(`</row>`)
+
+	// Flush the buffer every row so it doesn't grow with the payload
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for r, row := range rows {
+		buf.Reset()
+		n := r + 2 // 1-based, after the header
+		buf.WriteString(`<row r="` + strconv.Itoa(n) + `">`)
+		for i := range headers {
+			writeXLSXCell(&buf, cellRef(i, n), cell(row, i), 0)
+		}
+		buf.WriteString(`</row>`)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, `</sheetData></worksheet>`)
+	return err
+}
+
+// Writes a single cell. Nulls are left out entirely (an empty cell), numbers
+// and booleans are typed, and everything else is an inline string.
+func writeXLSXCell(buf *bytes.Buffer, ref string, v interface{}, style int) {
+	if v == nil {
+		return
+	}
+
+	attrs := `r="` + ref + `"`
+	if style != 0 {
+		attrs += ` s="` + strconv.Itoa(style) + `"`
+	}
+
+	if b, ok := v.(bool); ok {
+		value := "0"
+		if b {
+			value = "1"
+		}
+		buf.WriteString(`<c ` + attrs + ` t="b"><v>` + value + `</v></c>`)
+		return
+	}
+
+	// Excel has no representation for NaN or infinities; they fall through
+	// to strings
+	if x, ok := toFloat(v); ok && !math.IsNaN(x) && !math.IsInf(x, 0) {
+		buf.WriteString(
+			`<c ` + attrs + `><v>` +
+				strconv.FormatFloat(x, 'g', -1, 64) +
+				`</v></c>`,
+		)
+		return
+	}
+
+	buf.WriteString(`<c ` + attrs + ` t="inlineStr"><is><t xml:space="preserve">`)
+	xml.EscapeText(buf, []byte(stringify(v)))
+	buf.WriteString(`</t></is></c>`)
+}
+
+// `cellRef()` returns the A1-style reference for the 0-based column `col` and
+// the 1-based row `row` (e.g., (0, 1) is "A1" and (27, 3) is "AB3").
+func cellRef(col, row int) string {
+	var name []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = append([]byte{byte('A' + (col-1)%26)}, name...)
+	}
+	return string(name) + strconv.Itoa(row)
+}